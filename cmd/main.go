@@ -10,6 +10,7 @@ import (
 
 	"github.com/dovics/keda-ingress-nginx-scaler/pkg/scaler"
 	"github.com/dovics/keda-ingress-nginx-scaler/pkg/server"
+	"github.com/dovics/keda-ingress-nginx-scaler/pkg/utils"
 )
 
 func main() {
@@ -18,12 +19,17 @@ func main() {
 	var kubeconfig string
 	var interval time.Duration
 	var cacheDuration time.Duration
+	var scrapeOptions utils.ScrapeOptions
+	var scrapeConfigFile string
 
 	flag.IntVar(&port, "port", 9443, "Port number to serve webhooks. Defaults to 9443")
 	// flag.StringVar(&labelSelector, "label-selector", "", "Label selector to filter events. Defaults to empty string")
 	flag.StringVar(&kubeconfig, "kubeconfig", "", "Path to kubeconfig file. Defaults to in-cluster config")
 	flag.DurationVar(&interval, "interval", 10*time.Second, "Interval to fetch metrics. Defaults to 10 seconds")
 	flag.DurationVar(&cacheDuration, "cache-duration", 5*time.Minute, "Duration to cache metrics. Defaults to 5 minutes")
+	flag.DurationVar(&scrapeOptions.Timeout, "scrape-timeout", 0, "Timeout of a single scrape of a controller. Defaults to the interval")
+	flag.IntVar(&scrapeOptions.Concurrency, "scrape-concurrency", utils.DefaultScrapeConcurrency, "Number of controllers scraped at once. Defaults to 16")
+	flag.StringVar(&scrapeConfigFile, "scrape-config", "", "Path to a file configuring TLS, authentication and headers of scrapes by ingress class. Defaults to plain HTTP")
 
 	// Initialize klog flags
 	klog.InitFlags(nil)
@@ -40,15 +46,29 @@ func main() {
 		klog.Fatalf("Failed to create clientset: %v", err)
 	}
 
+	var scrapeConfigs *utils.ScrapeConfigs
+	if scrapeConfigFile != "" {
+		scrapeConfigs, err = utils.LoadScrapeConfigs(scrapeConfigFile)
+		if err != nil {
+			klog.Fatalf("Failed to load scrape config: %v", err)
+		}
+	}
+	endpoints := scaler.NewMetricsEndpoints(scrapeConfigs)
+
 	server := server.NewServer(port)
-	cache := scaler.NewMetricsAddrCache(clientset, labelSelector,
-		scaler.GetIngressIdentity, scaler.GetIngressMetricsAddr)
+	cache := utils.NewMetricsAddrCache(clientset, labelSelector,
+		scaler.GetIngressIdentity, endpoints.Addr)
+	cache.SetUpdateFunc(endpoints.Retain)
 
 	stopCh := make(chan struct{})
 	defer close(stopCh)
 	go cache.Run(stopCh)
 
 	scaler := scaler.NewIngressNginxScaler(clientset, cache, interval, cacheDuration)
+	scaler.SetScrapeOptions(scrapeOptions)
+	scaler.SetScrapeConfigFunc(endpoints.Config)
+	go scaler.Run(stopCh)
+
 	klog.V(2).Info("Starting scaler server")
 	if err := server.Start(scaler); err != nil {
 		klog.Fatal(err)
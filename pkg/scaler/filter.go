@@ -0,0 +1,122 @@
+package scaler
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// StatusClassLabel is not exported by ingress-nginx, it is derived from the
+// status label so that filters can match on e.g. 5xx.
+const StatusClassLabel model.LabelName = "statusClass"
+
+// FilterLabels are the scaler metadata keys that restrict which series of an
+// ingress a trigger accounts for, together with the label they match on.
+var FilterLabels = map[string]model.LabelName{
+	"host":        "host",
+	"path":        "path",
+	"method":      "method",
+	"statusClass": StatusClassLabel,
+}
+
+// labelMatcher matches a label value against a glob, where * matches any
+// run of characters including / and ? any single character, or against a
+// regular expression if the pattern starts with ~, like nginx locations do.
+type labelMatcher struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+func newLabelMatcher(pattern string, caseInsensitive bool) (*labelMatcher, error) {
+	expr, isRegexp := strings.CutPrefix(pattern, "~")
+	if !isRegexp {
+		expr = regexp.QuoteMeta(pattern)
+		expr = strings.ReplaceAll(expr, `\*`, ".*")
+		expr = strings.ReplaceAll(expr, `\?`, ".")
+		expr = "^" + expr + "$"
+	}
+	if caseInsensitive {
+		expr = "(?i)" + expr
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &labelMatcher{pattern: pattern, re: re}, nil
+}
+
+func (m *labelMatcher) matches(value string) bool {
+	return m.re.MatchString(value)
+}
+
+// seriesFilter selects the series of an ingress a trigger is interested in.
+// The zero value selects every series.
+type seriesFilter struct {
+	matchers map[model.LabelName]*labelMatcher
+}
+
+// with returns a copy of f that additionally requires label to match
+// pattern.
+func (f seriesFilter) with(label model.LabelName, pattern string) (seriesFilter, error) {
+	// hosts and methods are case insensitive in HTTP
+	matcher, err := newLabelMatcher(pattern, label == "host" || label == "method")
+	if err != nil {
+		return f, fmt.Errorf("invalid %s pattern %q: %v", label, pattern, err)
+	}
+
+	result := seriesFilter{matchers: make(map[model.LabelName]*labelMatcher, len(f.matchers)+1)}
+	for name, m := range f.matchers {
+		result.matchers[name] = m
+	}
+	result.matchers[label] = matcher
+
+	return result, nil
+}
+
+func (f seriesFilter) matches(labels model.Metric) bool {
+	for name, matcher := range f.matchers {
+		if !matcher.matches(labelValue(labels, name)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// String renders f canonically, so that equal filters share an index.
+func (f seriesFilter) String() string {
+	parts := make([]string, 0, len(f.matchers))
+	for name, matcher := range f.matchers {
+		parts = append(parts, fmt.Sprintf("%s=%q", name, matcher.pattern))
+	}
+	sort.Strings(parts)
+
+	return strings.Join(parts, ",")
+}
+
+// index is the cache index the series of the ingress identified by key
+// selected by f are accounted under.
+func (f seriesFilter) index(key string) string {
+	if len(f.matchers) == 0 {
+		return key
+	}
+
+	return key + "{" + f.String() + "}"
+}
+
+func labelValue(labels model.Metric, name model.LabelName) string {
+	if name == StatusClassLabel {
+		if code := string(labels["status"]); len(code) == 3 {
+			return code[:1] + "xx"
+		}
+
+		return ""
+	}
+
+	return string(labels[name])
+}
@@ -0,0 +1,74 @@
+package scaler
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func mustFilter(t *testing.T, patterns ...string) seriesFilter {
+	t.Helper()
+
+	var filter seriesFilter
+	for i := 0; i < len(patterns); i += 2 {
+		var err error
+		filter, err = filter.with(FilterLabels[patterns[i]], patterns[i+1])
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	return filter
+}
+
+func TestSeriesFilterMatches(t *testing.T) {
+	labels := model.Metric{
+		"ingress": "web",
+		"host":    "api.example.com",
+		"path":    "/api/v1",
+		"method":  "GET",
+		"status":  "503",
+	}
+
+	tests := []struct {
+		patterns []string
+		expected bool
+	}{
+		{nil, true},
+		{[]string{"host", "*.example.com"}, true},
+		{[]string{"host", "API.example.com"}, true},
+		{[]string{"host", "example.com"}, false},
+		{[]string{"path", "/api/*"}, true},
+		{[]string{"path", "/api"}, false},
+		{[]string{"path", "~^/api/v[12]$"}, true},
+		{[]string{"path", "~^/static"}, false},
+		{[]string{"method", "get"}, true},
+		{[]string{"statusClass", "5xx"}, true},
+		{[]string{"statusClass", "~[45]xx"}, true},
+		{[]string{"statusClass", "2xx"}, false},
+		{[]string{"host", "api.*", "method", "POST"}, false},
+	}
+
+	for _, test := range tests {
+		filter := mustFilter(t, test.patterns...)
+		if filter.matches(labels) != test.expected {
+			t.Errorf("Expected filter %s to match %t", filter, test.expected)
+		}
+	}
+}
+
+func TestSeriesFilterIndex(t *testing.T) {
+	if index := mustFilter(t).index("default/web"); index != "default/web" {
+		t.Errorf("Expected empty filter to use the ingress index, got %s", index)
+	}
+
+	a := mustFilter(t, "path", "/api/*", "method", "GET")
+	b := mustFilter(t, "method", "GET", "path", "/api/*")
+	if a.index("default/web") != b.index("default/web") {
+		t.Errorf("Expected equal filters to share an index, got %s and %s", a.index("default/web"), b.index("default/web"))
+	}
+
+	if _, err := a.with("path", "~("); err == nil {
+		t.Error("Expected error for invalid regular expression")
+	}
+}
@@ -0,0 +1,316 @@
+package scaler
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+)
+
+const (
+	// maxFormulaLength and maxFormulaDepth bound the work of parsing and
+	// evaluating user supplied formulas.
+	maxFormulaLength = 1024
+	maxFormulaDepth  = 32
+)
+
+// expression is a parsed arithmetic formula over named sub-queries. It only
+// knows numbers, variables, + - * /, parentheses and the functions in
+// formulaFunctions, so evaluating it is always safe.
+type expression interface {
+	eval(vars map[string]float64) float64
+}
+
+type numberExpr float64
+
+func (e numberExpr) eval(map[string]float64) float64 {
+	return float64(e)
+}
+
+type variableExpr string
+
+func (e variableExpr) eval(vars map[string]float64) float64 {
+	return vars[string(e)]
+}
+
+type negateExpr struct {
+	x expression
+}
+
+func (e negateExpr) eval(vars map[string]float64) float64 {
+	return -e.x.eval(vars)
+}
+
+type binaryExpr struct {
+	op   byte
+	x, y expression
+}
+
+func (e binaryExpr) eval(vars map[string]float64) float64 {
+	x, y := e.x.eval(vars), e.y.eval(vars)
+	switch e.op {
+	case '+':
+		return x + y
+	case '-':
+		return x - y
+	case '*':
+		return x * y
+	}
+
+	// an idle ingress must not turn the metric into infinity
+	if y == 0 {
+		return 0
+	}
+	return x / y
+}
+
+type callExpr struct {
+	fn   formulaFunction
+	args []expression
+}
+
+func (e callExpr) eval(vars map[string]float64) float64 {
+	args := make([]float64, len(e.args))
+	for i, arg := range e.args {
+		args[i] = arg.eval(vars)
+	}
+
+	return e.fn.call(args)
+}
+
+type formulaFunction struct {
+	// minArgs and maxArgs bound the number of arguments, a negative
+	// maxArgs allows any number.
+	minArgs, maxArgs int
+	call             func(args []float64) float64
+}
+
+var formulaFunctions = map[string]formulaFunction{
+	"min": {1, -1, func(args []float64) float64 {
+		result := args[0]
+		for _, arg := range args[1:] {
+			result = math.Min(result, arg)
+		}
+		return result
+	}},
+	"max": {1, -1, func(args []float64) float64 {
+		result := args[0]
+		for _, arg := range args[1:] {
+			result = math.Max(result, arg)
+		}
+		return result
+	}},
+	"abs": {1, 1, func(args []float64) float64 {
+		return math.Abs(args[0])
+	}},
+}
+
+// parseFormula parses src, accepting only the variables isVariable approves
+// of. It returns the distinct variables used, in order of appearance.
+func parseFormula(src string, isVariable func(name string) bool) (expression, []string, error) {
+	if len(src) > maxFormulaLength {
+		return nil, nil, fmt.Errorf("formula is longer than %d characters", maxFormulaLength)
+	}
+
+	p := &formulaParser{src: src, isVariable: isVariable}
+	expr, err := p.parseSum()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.skipSpace()
+	if p.pos < len(p.src) {
+		return nil, nil, p.errorf("unexpected %q", p.src[p.pos])
+	}
+
+	return expr, p.variables, nil
+}
+
+// formulaParser is a recursive descent parser of the grammar
+//
+//	sum     = product { ("+" | "-") product }
+//	product = unary { ("*" | "/") unary }
+//	unary   = "-" unary | primary
+//	primary = number | name | name "(" sum { "," sum } ")" | "(" sum ")"
+type formulaParser struct {
+	src   string
+	pos   int
+	depth int
+
+	isVariable func(name string) bool
+	variables  []string
+}
+
+func (p *formulaParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("formula at %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *formulaParser) skipSpace() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// accept consumes c if it is the next character.
+func (p *formulaParser) accept(c byte) bool {
+	p.skipSpace()
+	if p.pos < len(p.src) && p.src[p.pos] == c {
+		p.pos++
+		return true
+	}
+
+	return false
+}
+
+func (p *formulaParser) parseSum() (expression, error) {
+	x, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op := byte('+')
+		if !p.accept(op) {
+			if op = '-'; !p.accept(op) {
+				return x, nil
+			}
+		}
+
+		y, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		x = binaryExpr{op: op, x: x, y: y}
+	}
+}
+
+func (p *formulaParser) parseProduct() (expression, error) {
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op := byte('*')
+		if !p.accept(op) {
+			if op = '/'; !p.accept(op) {
+				return x, nil
+			}
+		}
+
+		y, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		x = binaryExpr{op: op, x: x, y: y}
+	}
+}
+
+func (p *formulaParser) parseUnary() (expression, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxFormulaDepth {
+		return nil, p.errorf("nested deeper than %d", maxFormulaDepth)
+	}
+
+	if p.accept('-') {
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return negateExpr{x: x}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *formulaParser) parsePrimary() (expression, error) {
+	if p.accept('(') {
+		x, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(')') {
+			return nil, p.errorf("missing )")
+		}
+		return x, nil
+	}
+
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return nil, p.errorf("unexpected end")
+	}
+
+	start := p.pos
+	switch c := p.src[p.pos]; {
+	case isDigit(c) || c == '.':
+		for p.pos < len(p.src) && (isDigit(p.src[p.pos]) || p.src[p.pos] == '.') {
+			p.pos++
+		}
+		number, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("formula at %d: invalid number %q", start, p.src[start:p.pos])
+		}
+		return numberExpr(number), nil
+	case isLetter(c):
+		for p.pos < len(p.src) && (isLetter(p.src[p.pos]) || isDigit(p.src[p.pos])) {
+			p.pos++
+		}
+		name := p.src[start:p.pos]
+		if p.accept('(') {
+			return p.parseCall(name)
+		}
+		return p.variable(name)
+	default:
+		return nil, p.errorf("unexpected %q", c)
+	}
+}
+
+func (p *formulaParser) parseCall(name string) (expression, error) {
+	fn, ok := formulaFunctions[name]
+	if !ok {
+		return nil, p.errorf("unknown function %s", name)
+	}
+
+	var args []expression
+	for {
+		arg, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+
+		if p.accept(')') {
+			break
+		}
+		if !p.accept(',') {
+			return nil, p.errorf("missing ) after arguments of %s", name)
+		}
+	}
+
+	if len(args) < fn.minArgs || (fn.maxArgs >= 0 && len(args) > fn.maxArgs) {
+		return nil, p.errorf("wrong number of arguments to %s", name)
+	}
+
+	return callExpr{fn: fn, args: args}, nil
+}
+
+func (p *formulaParser) variable(name string) (expression, error) {
+	if !p.isVariable(name) {
+		return nil, p.errorf("unknown variable %s", name)
+	}
+
+	if !slices.Contains(p.variables, name) {
+		p.variables = append(p.variables, name)
+	}
+
+	return variableExpr(name), nil
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_'
+}
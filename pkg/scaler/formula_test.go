@@ -0,0 +1,55 @@
+package scaler
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFormulaEval(t *testing.T) {
+	vars := map[string]float64{"qps": 200, "errorRate": 0.5, "p95": 0.3}
+	isVariable := func(name string) bool {
+		_, ok := vars[name]
+		return ok
+	}
+
+	tests := []struct {
+		formula  string
+		expected float64
+	}{
+		{"qps", 200},
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"8 / 4 / 2", 1},
+		{"-qps + 1", -199},
+		{"qps * (1 + errorRate*4)", 600},
+		{"max(qps/100, p95/0.2)", 2},
+		{"min(qps, 1.5, 3)", 1.5},
+		{"abs(-2.5)", 2.5},
+		{"qps / 0", 0},
+	}
+
+	for _, test := range tests {
+		expr, _, err := parseFormula(test.formula, isVariable)
+		if err != nil {
+			t.Errorf("Expected no error for %q, got %v", test.formula, err)
+			continue
+		}
+		if value := expr.eval(vars); math.Abs(value-test.expected) > 1e-9 {
+			t.Errorf("Expected %q to be %f, got %f", test.formula, test.expected, value)
+		}
+	}
+}
+
+func TestParseFormulaErrors(t *testing.T) {
+	isVariable := func(name string) bool { return name == "qps" }
+
+	for _, formula := range []string{
+		"", "qps qps", "qps +", "(qps", "qps)", "1..2", "rps", "exec(qps)", "max(qps,", "abs()", "qps; 1",
+		"((((((((((((((((((((((((((((((((((qps))))))))))))))))))))))))))))))))))",
+	} {
+		if _, _, err := parseFormula(formula, isVariable); err == nil {
+			t.Errorf("Expected an error for %q", formula)
+		}
+	}
+}
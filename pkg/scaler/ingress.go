@@ -3,14 +3,24 @@ package scaler
 import (
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	"k8s.io/klog/v2"
+
+	"github.com/dovics/keda-ingress-nginx-scaler/pkg/utils"
 )
 
-const DefaultHealthzPort = 10254
+const (
+	DefaultHealthzPort = 10254
+
+	CanaryAnnotation = "nginx.ingress.kubernetes.io/canary"
+)
 
 func GetIngressIdentity(pod *corev1.Pod) (string, error) {
 	if !IsIngressController(pod) {
@@ -21,7 +31,88 @@ func GetIngressIdentity(pod *corev1.Pod) (string, error) {
 }
 
 func GetIngressMetricsAddr(pod *corev1.Pod) (string, error) {
-	return fmt.Sprintf("http://%s:%d/metrics", pod.Status.PodIP, GetHealthzPortForIngressController(pod)), nil
+	return metricsAddr(pod, nil), nil
+}
+
+// metricsAddr returns the metrics endpoint of the controller pod, as
+// configured by config if not nil.
+func metricsAddr(pod *corev1.Pod, config *utils.ScrapeConfig) string {
+	addr := url.URL{Scheme: "http", Path: "/metrics"}
+	port := GetHealthzPortForIngressController(pod)
+	if config != nil {
+		if config.Scheme != "" {
+			addr.Scheme = config.Scheme
+		}
+		if config.Port != 0 {
+			port = config.Port
+		}
+		if config.Path != "" {
+			addr.Path = config.Path
+		}
+	}
+	addr.Host = net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(port))
+
+	return addr.String()
+}
+
+// MetricsEndpoints resolves the metrics endpoints of controller pods with
+// the scrape config of their ingress class, and remembers which config
+// applies to which endpoint.
+type MetricsEndpoints struct {
+	configs *utils.ScrapeConfigs
+
+	byAddr map[string]*utils.ScrapeConfig
+	mu     sync.RWMutex
+}
+
+func NewMetricsEndpoints(configs *utils.ScrapeConfigs) *MetricsEndpoints {
+	return &MetricsEndpoints{
+		configs: configs,
+		byAddr:  make(map[string]*utils.ScrapeConfig),
+	}
+}
+
+// Addr is GetIngressMetricsAddr for the scrape config of the ingress class
+// of pod.
+func (e *MetricsEndpoints) Addr(pod *corev1.Pod) (string, error) {
+	config := e.configs.Match(GetIngressClass(pod))
+	addr := metricsAddr(pod, config)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// pod IPs are reused, the latest pod at an address decides
+	if config == nil {
+		delete(e.byAddr, addr)
+	} else {
+		e.byAddr[addr] = config
+	}
+
+	return addr, nil
+}
+
+// Retain forgets the configs of all endpoints but addrs, the endpoints of
+// the current controller pods.
+func (e *MetricsEndpoints) Retain(addrs []string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	byAddr := make(map[string]*utils.ScrapeConfig, len(addrs))
+	for _, addr := range addrs {
+		if config, ok := e.byAddr[addr]; ok {
+			byAddr[addr] = config
+		}
+	}
+	e.byAddr = byAddr
+}
+
+// Config returns the scrape config of the endpoint addr, nil for the
+// defaults.
+func (e *MetricsEndpoints) Config(addr string) *utils.ScrapeConfig {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.byAddr[addr]
 }
 
 func IsIngressController(pod *corev1.Pod) bool {
@@ -77,3 +168,45 @@ func GetHealthzPortForIngressController(pod *corev1.Pod) int {
 	klog.V(4).Infof("Using default healthz port: %d", DefaultHealthzPort)
 	return DefaultHealthzPort
 }
+
+// IsIngressBackend reports whether the ingress routes any traffic, including
+// its default backend, to the service.
+func IsIngressBackend(ingress *networkingv1.Ingress, service string) bool {
+	if backend := ingress.Spec.DefaultBackend; backend != nil && backend.Service != nil && backend.Service.Name == service {
+		return true
+	}
+
+	for _, rule := range ingress.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+
+		for _, path := range rule.HTTP.Paths {
+			if path.Backend.Service != nil && path.Backend.Service.Name == service {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// IsCanaryIngress reports whether ingress-nginx treats the ingress as the
+// canary of another ingress serving the same host.
+func IsCanaryIngress(ingress *networkingv1.Ingress) bool {
+	canary, err := strconv.ParseBool(ingress.Annotations[CanaryAnnotation])
+	return err == nil && canary
+}
+
+// SharesHost reports whether both ingresses have a rule for the same host.
+func SharesHost(a, b *networkingv1.Ingress) bool {
+	for _, ruleA := range a.Spec.Rules {
+		for _, ruleB := range b.Spec.Rules {
+			if ruleA.Host == ruleB.Host {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,68 @@
+package scaler
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/dovics/keda-ingress-nginx-scaler/pkg/utils"
+)
+
+func newControllerPod(name, ip string, args ...string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ingress-nginx", Name: name},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name: "controller",
+			Args: append([]string{"/nginx-ingress-controller"}, args...),
+		}}},
+		Status: corev1.PodStatus{PodIP: ip},
+	}
+}
+
+func TestMetricsEndpoints(t *testing.T) {
+	secure := &utils.ScrapeConfig{IngressClass: "internal-*", Scheme: "https", Port: 8443, Path: "/secure/metrics"}
+	endpoints := NewMetricsEndpoints(&utils.ScrapeConfigs{IngressClasses: []*utils.ScrapeConfig{secure}})
+
+	tests := []struct {
+		pod      *corev1.Pod
+		expected string
+		config   *utils.ScrapeConfig
+	}{
+		{newControllerPod("a", "10.0.0.1", "--ingress-class=internal-nginx"), "https://10.0.0.1:8443/secure/metrics", secure},
+		{newControllerPod("b", "10.0.0.2", "--ingress-class=nginx", "--healthz-port=9000"), "http://10.0.0.2:9000/metrics", nil},
+		{newControllerPod("c", "fd00::3", "--ingress-class=nginx"), "http://[fd00::3]:10254/metrics", nil},
+	}
+
+	for _, test := range tests {
+		addr, err := endpoints.Addr(test.pod)
+		if err != nil {
+			t.Errorf("Expected no error for pod %s, got %v", test.pod.Name, err)
+			continue
+		}
+		if addr != test.expected {
+			t.Errorf("Expected address %s for pod %s, got %s", test.expected, test.pod.Name, addr)
+		}
+		if config := endpoints.Config(addr); config != test.config {
+			t.Errorf("Expected config %v for pod %s, got %v", test.config, test.pod.Name, config)
+		}
+	}
+
+	// a pod of another class reusing the address of a configured one is
+	// scraped with the defaults again
+	authorized := &utils.ScrapeConfig{IngressClass: "internal-*", Headers: map[string]string{"X-Scope": "metrics"}}
+	endpoints = NewMetricsEndpoints(&utils.ScrapeConfigs{IngressClasses: []*utils.ScrapeConfig{authorized}})
+	first, _ := endpoints.Addr(newControllerPod("d", "10.0.0.4", "--ingress-class=internal-nginx"))
+	second, _ := endpoints.Addr(newControllerPod("e", "10.0.0.4", "--ingress-class=nginx"))
+	if first != second || endpoints.Config(second) != nil {
+		t.Errorf("Expected the defaults for the reused address %s, got %v", second, endpoints.Config(second))
+	}
+
+	// the configs of deleted pods are forgotten
+	kept, _ := endpoints.Addr(newControllerPod("f", "10.0.0.6", "--ingress-class=internal-nginx"))
+	deleted, _ := endpoints.Addr(newControllerPod("g", "10.0.0.7", "--ingress-class=internal-nginx"))
+	endpoints.Retain([]string{kept})
+	if endpoints.Config(kept) != authorized || endpoints.Config(deleted) != nil {
+		t.Errorf("Expected only the config of %s to be kept, got %v and %v", kept, endpoints.Config(kept), endpoints.Config(deleted))
+	}
+}
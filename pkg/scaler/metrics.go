@@ -0,0 +1,425 @@
+package scaler
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/dovics/keda-ingress-nginx-scaler/pkg/utils"
+)
+
+// metricValue computes the value of the trigger's metric over its period,
+// or over the part of it the caches cover while they warm up.
+func (s *IngressNginxScaler) metricValue(metadata *IngressNginxScalerMetadata) (float64, error) {
+	metadata, err := s.windowed(metadata)
+	if err != nil {
+		return 0, err
+	}
+
+	switch metadata.metric {
+	case MetricTypeLatency:
+		return s.latency(metadata)
+	case MetricTypeUpstreamLatency:
+		return s.upstreamLatency(metadata)
+	case MetricTypeErrorRatio:
+		return s.errorRatio(metadata)
+	case MetricTypeErrorRate:
+		return s.rate(metadata, metadata.errorFilter)
+	case MetricTypeConcurrency:
+		return s.concurrency(metadata)
+	case MetricTypeBytes:
+		return s.bytes(metadata)
+	case MetricTypeConnections:
+		return s.connections(metadata)
+	case MetricTypeFormula:
+		return s.formula(metadata)
+	}
+
+	return s.rate(metadata, metadata.filter)
+}
+
+// windowed returns metadata itself if the caches cover its whole period, or
+// a copy of it with the period cut down to the part they do cover, e.g.
+// right after start or for an ingress that just appeared. It fails with
+// utils.ErrNotCovered if that part is shorter than minWindow, by default two
+// scrape intervals or the period if it is shorter, and with utils.ErrStale if
+// a cache has not scraped any controller for longer than staleAfter, three
+// scrape intervals by default. Formulas are windowed per sub-query.
+func (s *IngressNginxScaler) windowed(metadata *IngressNginxScalerMetadata) (*IngressNginxScalerMetadata, error) {
+	if metadata.metric == MetricTypeFormula {
+		return metadata, nil
+	}
+
+	window := min(metadata.period, s.cacheDuration)
+	var lastScrape time.Time
+	coverage := 1.0
+	for _, glob := range metadata.ingressClassGlobs() {
+		for _, family := range metadata.metricFamilies() {
+			cache := s.getMetricsCache(family, glob)
+			for _, index := range metadata.cacheIndexes(glob) {
+				window = min(window, cache.Covered(family, index))
+			}
+			if last := cache.LastScrape(); lastScrape.IsZero() || last.Before(lastScrape) {
+				lastScrape = last
+			}
+			coverage = min(coverage, cache.Coverage())
+		}
+	}
+
+	minWindow := metadata.minWindow
+	if minWindow == 0 {
+		minWindow = min(2*s.interval, metadata.period)
+	}
+	if window < minWindow {
+		return nil, fmt.Errorf("%w: %s of %s collected, %s needed", utils.ErrNotCovered, window, metadata.period, minWindow)
+	}
+
+	staleAfter := metadata.staleAfter
+	if staleAfter == 0 {
+		staleAfter = 3 * s.interval
+	}
+	if age := time.Since(lastScrape); age > staleAfter {
+		return nil, fmt.Errorf("%w: last scraped %s ago", utils.ErrStale, age.Truncate(time.Second))
+	}
+	if coverage < 1 {
+		klog.V(2).Infof("scalerobject %s/%s computes %s from %.0f%% of the controllers", metadata.namespace, metadata.name, metadata.metric, coverage*100)
+	}
+	if window == metadata.period {
+		return metadata, nil
+	}
+
+	klog.V(4).Infof("scalerobject %s/%s computes %s over %s of %s, last scraped %s ago",
+		metadata.namespace, metadata.name, metadata.metric, window, metadata.period, time.Since(lastScrape))
+	partial := *metadata
+	partial.period = window
+	return &partial, nil
+}
+
+// increase sums up the increase of the series of family selected by filter
+// over the period across all ingresses of the trigger.
+func (s *IngressNginxScaler) increase(metadata *IngressNginxScalerMetadata, family string, filter seriesFilter) (utils.Sample, error) {
+	var total utils.Sample
+	for _, ingress := range metadata.ingresses {
+		cache := s.getMetricsCache(family, ingress.ingressClassGlob)
+		increase, err := cache.Increase(family, filter.index(ingressKey(metadata.namespace, ingress.name)), metadata.period)
+		if err != nil {
+			return utils.Sample{}, err
+		}
+
+		total = total.Add(increase)
+	}
+
+	return total, nil
+}
+
+// rates returns the per second rates of the series of family selected by
+// filter for every scrape interval within the period across all ingresses
+// of the trigger, oldest first. The rates of ingresses scraped by different
+// caches are lined up from the most recent one.
+func (s *IngressNginxScaler) rates(metadata *IngressNginxScalerMetadata, family string, filter seriesFilter) ([]utils.Sample, error) {
+	var total []utils.Sample
+	for _, glob := range metadata.ingressClassGlobs() {
+		var indexes []string
+		for _, ingress := range metadata.ingresses {
+			if ingress.ingressClassGlob == glob {
+				indexes = append(indexes, filter.index(ingressKey(metadata.namespace, ingress.name)))
+			}
+		}
+
+		rates, err := s.getMetricsCache(family, glob).Rates(family, indexes, metadata.period)
+		if err != nil {
+			return nil, err
+		}
+		total = addAligned(total, rates)
+	}
+
+	return total, nil
+}
+
+// addAligned adds up a and b from their ends, dropping what only the longer
+// of them has.
+func addAligned(a, b []utils.Sample) []utils.Sample {
+	if a == nil {
+		return b
+	}
+
+	n := min(len(a), len(b))
+	sum := make([]utils.Sample, n)
+	for i := range sum {
+		sum[i] = a[len(a)-n+i].Add(b[len(b)-n+i])
+	}
+
+	return sum
+}
+
+// rate returns the per second rate of the requests selected by filter,
+// aggregated as configured.
+func (s *IngressNginxScaler) rate(metadata *IngressNginxScalerMetadata, filter seriesFilter) (float64, error) {
+	if metadata.aggregation == "" || metadata.aggregation == AggregationAvg {
+		increase, err := s.increase(metadata, MetricsName, filter)
+		if err != nil {
+			return 0, err
+		}
+
+		return increase.Value / metadata.period.Seconds(), nil
+	}
+
+	rates, err := s.rates(metadata, MetricsName, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	values := make([]float64, len(rates))
+	for i, rate := range rates {
+		values[i] = rate.Value
+	}
+
+	return aggregate(values, metadata.aggregation), nil
+}
+
+// aggregate returns the average, the maximum or the percentile of values
+// aggregation asks for, or zero if there are none. Percentiles interpolate
+// between the closest ranks like quantile_over_time does.
+func aggregate(values []float64, aggregation string) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	if aggregation == AggregationMax {
+		return slices.Max(values)
+	}
+
+	quantile, ok := percentile(aggregation, "p")
+	if !ok {
+		var sum float64
+		for _, value := range values {
+			sum += value
+		}
+
+		return sum / float64(len(values))
+	}
+
+	sorted := slices.Sorted(slices.Values(values))
+	rank := quantile * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+// latency returns the configured quantile or the average of the request
+// duration in seconds over the period.
+func (s *IngressNginxScaler) latency(metadata *IngressNginxScalerMetadata) (float64, error) {
+	increase, err := s.increase(metadata, RequestDurationMetricsName, metadata.filter)
+	if err != nil {
+		return 0, err
+	}
+
+	return latencyOf(increase, metadata), nil
+}
+
+// upstreamLatency returns the configured quantile or the average of the time
+// spent waiting for the upstream in seconds over the period. Controllers
+// that do not export the response duration histogram yet still provide the
+// average through the upstream latency summary, but no quantiles.
+func (s *IngressNginxScaler) upstreamLatency(metadata *IngressNginxScalerMetadata) (float64, error) {
+	increase, err := s.increase(metadata, ResponseDurationMetricsName, metadata.filter)
+	if err != nil {
+		return 0, err
+	}
+	if increase.Value > 0 {
+		return latencyOf(increase, metadata), nil
+	}
+
+	summary, err := s.increase(metadata, UpstreamLatencyMetricsName, metadata.filter)
+	if err != nil {
+		return 0, err
+	}
+	if summary.Value > 0 && !metadata.average {
+		// reporting no latency would scale the upstream down under load
+		return 0, fmt.Errorf("quantiles need %s, the controllers only export the average", ResponseDurationMetricsName)
+	}
+
+	return latencyOf(summary, metadata), nil
+}
+
+// latencyOf returns the configured quantile or the average of the
+// observations in increase, or zero if there are none.
+func latencyOf(increase utils.Sample, metadata *IngressNginxScalerMetadata) float64 {
+	if increase.Value <= 0 {
+		return 0
+	}
+	if metadata.average {
+		return increase.Sum / increase.Value
+	}
+
+	latency := increase.Quantile(metadata.quantile)
+	if math.IsNaN(latency) {
+		return 0
+	}
+
+	return latency
+}
+
+// concurrency estimates the average number of requests in flight over the
+// period with Little's law, as the request rate times the mean request
+// duration. Both come from the duration histogram, so this boils down to
+// the increase of its sum divided by the period.
+func (s *IngressNginxScaler) concurrency(metadata *IngressNginxScalerMetadata) (float64, error) {
+	increase, err := s.increase(metadata, RequestDurationMetricsName, metadata.filter)
+	if err != nil {
+		return 0, err
+	}
+
+	return increase.Sum / metadata.period.Seconds(), nil
+}
+
+// bytes returns the bytes per second transferred in the configured
+// direction, from the sums of the request and response size histograms.
+func (s *IngressNginxScaler) bytes(metadata *IngressNginxScalerMetadata) (float64, error) {
+	if metadata.aggregation != "" && metadata.aggregation != AggregationAvg {
+		var total []utils.Sample
+		for _, family := range metadata.metricFamilies() {
+			rates, err := s.rates(metadata, family, metadata.filter)
+			if err != nil {
+				return 0, err
+			}
+			total = addAligned(total, rates)
+		}
+
+		values := make([]float64, len(total))
+		for i, rate := range total {
+			values[i] = rate.Sum
+		}
+
+		return aggregate(values, metadata.aggregation), nil
+	}
+
+	var bytes float64
+	for _, family := range metadata.metricFamilies() {
+		increase, err := s.increase(metadata, family, metadata.filter)
+		if err != nil {
+			return 0, err
+		}
+
+		bytes += increase.Sum
+	}
+
+	return bytes / metadata.period.Seconds(), nil
+}
+
+// connections returns the number of connections in the configured state
+// over the period aggregated as configured, summed up over the controllers
+// of every ingress class the ingresses of the trigger belong to.
+func (s *IngressNginxScaler) connections(metadata *IngressNginxScalerMetadata) (float64, error) {
+	var connections float64
+	for _, glob := range metadata.ingressClassGlobs() {
+		cache := s.getMetricsCache(ConnectionsMetricsName, glob)
+		totals, err := cache.Totals(ConnectionsMetricsName, metadata.connectionState, metadata.period)
+		if err != nil {
+			return 0, err
+		}
+		connections += aggregate(totals, metadata.aggregation)
+	}
+
+	return connections, nil
+}
+
+// formula evaluates the sub-queries the formula of the trigger refers to and
+// combines them.
+func (s *IngressNginxScaler) formula(metadata *IngressNginxScalerMetadata) (float64, error) {
+	vars := make(map[string]float64, len(metadata.formulaVariables))
+	for _, name := range metadata.formulaVariables {
+		query, _ := metadata.formulaQuery(name)
+		value, err := s.metricValue(query)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", name, err)
+		}
+		vars[name] = value
+	}
+
+	value := metadata.formula.eval(vars)
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("formula evaluated to %f", value)
+	}
+
+	return value, nil
+}
+
+// errorRatio returns the fraction of requests over the period that were
+// answered with the configured status class, or zero if there were none.
+func (s *IngressNginxScaler) errorRatio(metadata *IngressNginxScalerMetadata) (float64, error) {
+	total, err := s.increase(metadata, MetricsName, metadata.filter)
+	if err != nil {
+		return 0, err
+	}
+	if total.Value <= 0 {
+		return 0, nil
+	}
+
+	failed, err := s.increase(metadata, MetricsName, metadata.errorFilter)
+	if err != nil {
+		return 0, err
+	}
+
+	return math.Min(failed.Value/total.Value, 1), nil
+}
+
+// isTriggerActive reports whether any metric of the trigger is active.
+func (s *IngressNginxScaler) isTriggerActive(metadata *IngressNginxScalerMetadata) bool {
+	for _, metric := range metadata.metrics {
+		if s.isActive(metric) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isActive reports whether the rate of the requests of the trigger over its
+// period exceeds activationQps, like the activation thresholds of the
+// built-in KEDA scalers. The connections metric is not attributed to
+// requests, it is active once the connections exceed activationConnections.
+// Without enough data the trigger is not active, during warm-up the part of
+// the period that is covered counts.
+func (s *IngressNginxScaler) isActive(metadata *IngressNginxScalerMetadata) bool {
+	if metadata.metric == MetricTypeFormula {
+		for _, name := range metadata.formulaVariables {
+			if query, _ := metadata.formulaQuery(name); s.isActive(query) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	query := *metadata
+	if query.metric != MetricTypeConnections {
+		query.metric = MetricTypeQPS
+	}
+	windowed, err := s.windowed(&query)
+	if err != nil {
+		klog.V(4).Infof("scalerobject %s/%s get %s from metrics cache err: %v", metadata.namespace, metadata.name, query.metric, err)
+		return false
+	}
+	if query.metric == MetricTypeConnections {
+		connections, err := s.connections(windowed)
+		if err != nil {
+			klog.V(4).Infof("scalerobject %s/%s get connections from metrics cache err: %v", metadata.namespace, metadata.name, err)
+			return false
+		}
+
+		return connections > metadata.activationConnections
+	}
+
+	qps, err := s.rate(windowed, metadata.filter)
+	if err != nil {
+		klog.V(4).Infof("scalerobject %s/%s get qps from metrics cache err: %v", metadata.namespace, metadata.name, err)
+		return false
+	}
+
+	return qps > metadata.activationQps
+}
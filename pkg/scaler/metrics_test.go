@@ -0,0 +1,311 @@
+package scaler
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	pb "github.com/dovics/keda-ingress-nginx-scaler/pkg/api"
+)
+
+// testController serves one payload after the other to the scrapes of a
+// fed scaler, repeating the last one.
+type testController struct {
+	*httptest.Server
+	payloads []string
+	served   atomic.Int32
+}
+
+func newTestController(t *testing.T, payloads ...string) *testController {
+	c := &testController{payloads: payloads}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := min(int(c.served.Add(1)), len(c.payloads)) - 1
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprint(w, c.payloads[i])
+	}))
+	t.Cleanup(c.Close)
+
+	return c
+}
+
+// newFedScaler returns a scaler whose caches watch the controller, which
+// is only scraped by feed.
+func newFedScaler(t *testing.T, controller *testController, objects ...runtime.Object) *IngressNginxScaler {
+	t.Helper()
+
+	s := NewIngressNginxScaler(fake.NewClientset(objects...), testWatcher{addrs: []string{controller.URL}}, time.Second, time.Minute)
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+
+	go s.ingressInformer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, s.ingressInformer.HasSynced) {
+		t.Fatal("Failed to sync ingress informer")
+	}
+
+	return s
+}
+
+// feed scrapes the controller once per payload for the caches of the
+// trigger, one scrape interval apart and ending now.
+func (c *testController) feed(t *testing.T, s *IngressNginxScaler, scaledObject *pb.ScaledObjectRef) *IngressNginxScalerMetadata {
+	t.Helper()
+
+	metadata, err := s.parseIngressNginxScalerMetadata(context.Background(), scaledObject)
+	if err != nil {
+		t.Fatalf("Failed to parse metadata: %v", err)
+	}
+	for _, metric := range metadata.metrics {
+		for _, glob := range metric.ingressClassGlobs() {
+			for _, family := range metric.metricFamilies() {
+				s.getMetricsCache(family, glob)
+			}
+		}
+	}
+
+	start := time.Now().Add(-time.Duration(len(c.payloads)-1) * s.interval)
+	// the caches pick up the controller in the background
+	for deadline := time.Now().Add(5 * time.Second); c.served.Load() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Caches did not pick up the controller")
+		}
+		s.scrapes.ScrapeOnce(context.Background(), start)
+	}
+	for i := 1; i < len(c.payloads); i++ {
+		s.scrapes.ScrapeOnce(context.Background(), start.Add(time.Duration(i)*s.interval))
+	}
+
+	return metadata
+}
+
+// histogram renders the samples of the histogram family name with the
+// labels of the web ingress, half of count observed up to 0.1 and all of
+// them up to 0.5.
+func histogram(name string, count, sum float64) string {
+	labels := `namespace="default",ingress="web"`
+	return fmt.Sprintf("# TYPE %[1]s histogram\n"+
+		"%[1]s_bucket{%[2]s,le=\"0.1\"} %[3]g\n"+
+		"%[1]s_bucket{%[2]s,le=\"0.5\"} %[4]g\n"+
+		"%[1]s_bucket{%[2]s,le=\"+Inf\"} %[4]g\n"+
+		"%[1]s_sum{%[2]s} %[5]g\n"+
+		"%[1]s_count{%[2]s} %[4]g\n", name, labels, count/2, count, sum)
+}
+
+// expectValue checks that the metric of the trigger computes to expected.
+func expectValue(t *testing.T, s *IngressNginxScaler, metadata *IngressNginxScalerMetadata, expected float64) {
+	t.Helper()
+
+	value, err := s.metricValue(metadata)
+	if err != nil {
+		t.Fatalf("Failed to compute %s: %v", metadata.metric, err)
+	}
+	if math.Abs(value-expected) > 0.01*expected {
+		t.Errorf("Expected %s to be %f, got %f", metadata.metric, expected, value)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	values := []float64{10, 40, 20, 30, 100}
+
+	tests := []struct {
+		aggregation string
+		expected    float64
+	}{
+		{AggregationAvg, 40},
+		{AggregationMax, 100},
+		{"p50", 30},
+		{"p90", 76},
+		{"p99", 97.6},
+		{"p100", 100},
+	}
+
+	for _, test := range tests {
+		if value := aggregate(values, test.aggregation); math.Abs(value-test.expected) > 1e-9 {
+			t.Errorf("Expected %s to be %f, got %f", test.aggregation, test.expected, value)
+		}
+	}
+
+	if value := aggregate(nil, "p99"); value != 0 {
+		t.Errorf("Expected no values to aggregate to 0, got %f", value)
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	// 4 requests per second taking half a second each
+	var payloads []string
+	for i := range 6 {
+		payloads = append(payloads, histogram(RequestDurationMetricsName, float64(100+4*i), float64(50+2*i)))
+	}
+	controller := newTestController(t, payloads...)
+	s := newFedScaler(t, controller, newTestIngress("default", "web", "web"))
+
+	metadata := controller.feed(t, s, &pb.ScaledObjectRef{
+		Namespace: "default",
+		Name:      "web",
+		ScalerMetadata: map[string]string{
+			"ingressName":       "web",
+			"period":            "4s",
+			"metric":            MetricTypeConcurrency,
+			"targetConcurrency": "10",
+		},
+	})
+	expectValue(t, s, metadata, 2)
+}
+
+func TestBytes(t *testing.T) {
+	// 100 bytes per second in, 300 out
+	var payloads []string
+	for i := range 6 {
+		payloads = append(payloads, histogram(RequestSizeMetricsName, float64(10+i), float64(1000+100*i))+
+			histogram(ResponseSizeMetricsName, float64(10+i), float64(3000+300*i)))
+	}
+
+	tests := []struct {
+		direction string
+		expected  float64
+	}{
+		{DirectionIn, 100},
+		{DirectionOut, 300},
+		{DirectionBoth, 400},
+	}
+
+	for _, test := range tests {
+		controller := newTestController(t, payloads...)
+		s := newFedScaler(t, controller, newTestIngress("default", "web", "web"))
+
+		metadata := controller.feed(t, s, &pb.ScaledObjectRef{
+			Namespace: "default",
+			Name:      "web",
+			ScalerMetadata: map[string]string{
+				"ingressName":          "web",
+				"period":               "4s",
+				"metric":               MetricTypeBytes,
+				"direction":            test.direction,
+				"targetBytesPerSecond": "1Ki",
+			},
+		})
+		expectValue(t, s, metadata, test.expected)
+	}
+}
+
+func TestUpstreamLatency(t *testing.T) {
+	scaledObject := func(quantile string) *pb.ScaledObjectRef {
+		return &pb.ScaledObjectRef{
+			Namespace: "default",
+			Name:      "web",
+			ScalerMetadata: map[string]string{
+				"ingressName":   "web",
+				"period":        "4s",
+				"metric":        MetricTypeUpstreamLatency,
+				"quantile":      quantile,
+				"targetLatency": "1s",
+			},
+		}
+	}
+
+	// half of the responses within 0.1s, all of them within 0.5s
+	var payloads []string
+	for i := range 6 {
+		payloads = append(payloads, histogram(ResponseDurationMetricsName, float64(100+10*i), float64(20+2*i)))
+	}
+	controller := newTestController(t, payloads...)
+	s := newFedScaler(t, controller, newTestIngress("default", "web", "web"))
+	expectValue(t, s, controller.feed(t, s, scaledObject("0.9")), 0.42)
+
+	// controllers without the histogram only export the average
+	payloads = nil
+	for i := range 6 {
+		payloads = append(payloads, fmt.Sprintf("# TYPE %[1]s summary\n"+
+			"%[1]s_sum{namespace=\"default\",ingress=\"web\"} %[2]g\n"+
+			"%[1]s_count{namespace=\"default\",ingress=\"web\"} %[3]g\n",
+			UpstreamLatencyMetricsName, float64(20+2*i), float64(100+10*i)))
+	}
+	controller = newTestController(t, payloads...)
+	s = newFedScaler(t, controller, newTestIngress("default", "web", "web"))
+	expectValue(t, s, controller.feed(t, s, scaledObject(QuantileAverage)), 0.2)
+
+	// but no quantiles
+	metadata, err := s.parseIngressNginxScalerMetadata(context.Background(), scaledObject("0.9"))
+	if err != nil {
+		t.Fatalf("Failed to parse metadata: %v", err)
+	}
+	if value, err := s.metricValue(metadata); err == nil {
+		t.Errorf("Expected an error for a quantile of the summary, got %f", value)
+	}
+}
+
+func TestConnectionsActivation(t *testing.T) {
+	payload := fmt.Sprintf("# TYPE %[1]s gauge\n%[1]s{state=\"active\"} 5\n", ConnectionsMetricsName)
+
+	tests := []struct {
+		activation string
+		active     bool
+	}{
+		{"", true},
+		{"3", true},
+		{"10", false},
+	}
+
+	for _, test := range tests {
+		controller := newTestController(t, payload, payload, payload, payload, payload)
+		s := newFedScaler(t, controller, newTestIngress("default", "web", "web"))
+
+		metadata := controller.feed(t, s, &pb.ScaledObjectRef{
+			Namespace: "default",
+			Name:      "web",
+			ScalerMetadata: map[string]string{
+				"ingressName":           "web",
+				"period":                "4s",
+				"metric":                MetricTypeConnections,
+				"targetConnections":     "100",
+				"activationConnections": test.activation,
+			},
+		})
+		if active := s.isActive(metadata); active != test.active {
+			t.Errorf("Expected 5 connections with activationConnections %q to be active %t, got %t", test.activation, test.active, active)
+		}
+	}
+}
+
+func TestMinWindow(t *testing.T) {
+	payload := fmt.Sprintf("# TYPE %[1]s counter\n%[1]s{namespace=\"default\",ingress=\"web\"} 10\n", MetricsName)
+
+	// two scrapes cover a single scrape interval
+	tests := []struct {
+		period    string
+		minWindow string
+		covered   bool
+	}{
+		{"1s", "", true},
+		{"4s", "", false},
+		{"4s", "1s", true},
+		{"4s", "3s", false},
+	}
+
+	for _, test := range tests {
+		controller := newTestController(t, payload, payload)
+		s := newFedScaler(t, controller, newTestIngress("default", "web", "web"))
+
+		metadata := controller.feed(t, s, &pb.ScaledObjectRef{
+			Namespace: "default",
+			Name:      "web",
+			ScalerMetadata: map[string]string{
+				"ingressName": "web",
+				"period":      test.period,
+				"minWindow":   test.minWindow,
+				"qps":         "10",
+			},
+		})
+		if _, err := s.metricValue(metadata); (err == nil) != test.covered {
+			t.Errorf("Expected a period of %s with minWindow %q to be covered %t, got %v", test.period, test.minWindow, test.covered, err)
+		}
+	}
+}
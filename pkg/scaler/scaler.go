@@ -2,14 +2,26 @@ package scaler
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	networkingv1listers "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2"
 
 	pb "github.com/dovics/keda-ingress-nginx-scaler/pkg/api"
@@ -21,12 +33,223 @@ type IngressNginxScalerMetadata struct {
 	namespace string
 	name      string
 
-	ingressName      string
-	ingressClass     string
-	ingressClassGlob string
+	// ingresses are the ingresses whose traffic is summed up, resolved
+	// from ingressName, ingressNames or ingressSelector.
+	ingresses    []ingressTarget
+	ingressClass string
+	serviceName  string
+	canary       string
 
 	period time.Duration
-	qps    int64
+	// minWindow is the shortest part of the period metrics are computed
+	// over while the caches warm up, staleAfter how long after the last
+	// successful scrape they are still computed at all.
+	minWindow  time.Duration
+	staleAfter time.Duration
+	// activationQps is the request rate the trigger has to exceed to be
+	// active, heartbeat how often StreamIsActive repeats an unchanged
+	// state.
+	activationQps float64
+	heartbeat     time.Duration
+	metric        string
+	qps           int64
+	// target is the target value of every metric but qps.
+	target float64
+
+	// quantile of the latency metrics, or average instead
+	quantile  float64
+	average   bool
+	direction string
+
+	// activationConnections is the number of connections a connections
+	// trigger has to exceed to be active.
+	connectionState       string
+	activationConnections float64
+	aggregation           string
+
+	// formula combines the sub-queries named by formulaVariables.
+	formula          expression
+	formulaVariables []string
+
+	// metrics are all metrics of the trigger, starting with this one, when
+	// the metric key lists several of them.
+	metrics []*IngressNginxScalerMetadata
+
+	// filter selects the series the metric is computed from, errorFilter
+	// the subset of them that count as errors.
+	filter      seriesFilter
+	errorFilter seriesFilter
+}
+
+// ingressTarget is an ingress a trigger accounts for, along with the glob
+// matching the identities of the controllers serving it.
+type ingressTarget struct {
+	name             string
+	ingressClassGlob string
+}
+
+func (m *IngressNginxScalerMetadata) metricName() string {
+	switch m.metric {
+	case MetricTypeErrorRatio:
+		return "ingress-nginx-error-ratio"
+	case MetricTypeErrorRate:
+		return "ingress-nginx-error-rate"
+	case MetricTypeUpstreamLatency:
+		return "ingress-nginx-upstream-latency"
+	case MetricTypeConnections:
+		return fmt.Sprintf("ingress-nginx-%s-connections", m.connectionState)
+	}
+
+	return fmt.Sprintf("ingress-nginx-%s", m.metric)
+}
+
+// formulaQuery returns the metadata of the sub-query a formula refers to as
+// name, sharing the ingresses, period and filters of m. The names are
+//
+//	qps, errorRate, errorRatio, concurrency, bytesIn, bytesOut, connections
+//	latency, upstreamLatency   the average latency in seconds
+//	p95, upstreamP99, ...      latency quantiles in seconds
+func (m *IngressNginxScalerMetadata) formulaQuery(name string) (*IngressNginxScalerMetadata, bool) {
+	query := *m
+	query.formula, query.formulaVariables, query.metrics = nil, nil, nil
+	switch name {
+	case MetricTypeQPS, MetricTypeErrorRate, MetricTypeErrorRatio, MetricTypeConcurrency:
+		query.metric = name
+	case "bytesIn":
+		query.metric, query.direction = MetricTypeBytes, DirectionIn
+	case "bytesOut":
+		query.metric, query.direction = MetricTypeBytes, DirectionOut
+	case MetricTypeConnections:
+		query.metric = MetricTypeConnections
+		query.connectionState, query.aggregation = ConnectionStateActive, AggregationAvg
+	case MetricTypeLatency, MetricTypeUpstreamLatency:
+		query.metric, query.average = name, true
+	default:
+		query.metric = MetricTypeLatency
+		quantile, ok := percentile(name, "p")
+		if !ok {
+			query.metric = MetricTypeUpstreamLatency
+			if quantile, ok = percentile(name, "upstreamP"); !ok {
+				return nil, false
+			}
+		}
+		query.quantile, query.average = quantile, false
+	}
+
+	return &query, true
+}
+
+// percentile parses names like p95 or p999 made of prefix and at least two
+// digits as the quantile 0.95 or 0.999, and p100 as the maximum.
+func percentile(name, prefix string) (float64, bool) {
+	digits, ok := strings.CutPrefix(name, prefix)
+	if !ok || len(digits) < 2 || strings.Trim(digits, "0123456789") != "" {
+		return 0, false
+	}
+	if digits == "100" {
+		return 1, true
+	}
+
+	quantile, err := strconv.ParseFloat("0."+digits, 64)
+	if err != nil || quantile <= 0 {
+		return 0, false
+	}
+
+	return quantile, true
+}
+
+// ingressClassGlobs are the distinct globs of the controllers serving the
+// ingresses of the trigger.
+func (m *IngressNginxScalerMetadata) ingressClassGlobs() []string {
+	var globs []string
+	for _, ingress := range m.ingresses {
+		if !slices.Contains(globs, ingress.ingressClassGlob) {
+			globs = append(globs, ingress.ingressClassGlob)
+		}
+	}
+
+	return globs
+}
+
+// cacheIndexes are the indexes the metric reads from the cache of the
+// controllers matching glob.
+func (m *IngressNginxScalerMetadata) cacheIndexes(glob string) []string {
+	if m.metric == MetricTypeConnections {
+		return []string{m.connectionState}
+	}
+
+	var indexes []string
+	for _, ingress := range m.ingresses {
+		if ingress.ingressClassGlob != glob {
+			continue
+		}
+
+		key := ingressKey(m.namespace, ingress.name)
+		indexes = append(indexes, m.filter.index(key))
+		if index := m.errorFilter.index(key); index != key {
+			indexes = append(indexes, index)
+		}
+	}
+
+	return indexes
+}
+
+// metricFamilies are the metric families the metric is computed from.
+func (m *IngressNginxScalerMetadata) metricFamilies() []string {
+	switch m.metric {
+	case MetricTypeFormula:
+		var families []string
+		for _, name := range m.formulaVariables {
+			query, _ := m.formulaQuery(name)
+			for _, family := range query.metricFamilies() {
+				if !slices.Contains(families, family) {
+					families = append(families, family)
+				}
+			}
+		}
+
+		return families
+	case MetricTypeLatency, MetricTypeConcurrency:
+		return []string{RequestDurationMetricsName}
+	case MetricTypeUpstreamLatency:
+		return []string{ResponseDurationMetricsName, UpstreamLatencyMetricsName}
+	case MetricTypeConnections:
+		return []string{ConnectionsMetricsName}
+	case MetricTypeBytes:
+		switch m.direction {
+		case DirectionIn:
+			return []string{RequestSizeMetricsName}
+		case DirectionOut:
+			return []string{ResponseSizeMetricsName}
+		}
+
+		return []string{RequestSizeMetricsName, ResponseSizeMetricsName}
+	}
+
+	return []string{MetricsName}
+}
+
+// activationFamilies are the metric families isActive reads, the request
+// rate for every metric but connections.
+func (m *IngressNginxScalerMetadata) activationFamilies() []string {
+	switch m.metric {
+	case MetricTypeConnections:
+		return []string{ConnectionsMetricsName}
+	case MetricTypeFormula:
+		var families []string
+		for _, name := range m.formulaVariables {
+			query, _ := m.formulaQuery(name)
+			for _, family := range query.activationFamilies() {
+				if !slices.Contains(families, family) {
+					families = append(families, family)
+				}
+			}
+		}
+
+		return families
+	}
+
+	return []string{MetricsName}
 }
 
 func (s *IngressNginxScaler) parseIngressNginxScalerMetadata(ctx context.Context, scaledObject *pb.ScaledObjectRef) (*IngressNginxScalerMetadata, error) {
@@ -35,13 +258,6 @@ func (s *IngressNginxScaler) parseIngressNginxScalerMetadata(ctx context.Context
 		name:      scaledObject.Name,
 	}
 
-	ingressName, ok := scaledObject.ScalerMetadata["ingressName"]
-	if !ok || ingressName == "" {
-		klog.Errorf("scalerobject %s/%s ingressName must be specified", scaledObject.Namespace, scaledObject.Name)
-		return nil, status.Error(codes.InvalidArgument, "ingressName must be specified and not empty")
-	}
-	metadata.ingressName = ingressName
-
 	periodStr, ok := scaledObject.ScalerMetadata["period"]
 	if !ok || periodStr == "" {
 		klog.Errorf("scalerobject %s/%s period must be specified", scaledObject.Namespace, scaledObject.Name)
@@ -52,78 +268,737 @@ func (s *IngressNginxScaler) parseIngressNginxScalerMetadata(ctx context.Context
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
+	// the caches cannot answer for longer than they keep the samples
+	if period <= 0 || period > s.cacheDuration {
+		klog.Errorf("scalerobject %s/%s period %s is invalid", scaledObject.Namespace, scaledObject.Name, periodStr)
+		return nil, status.Errorf(codes.InvalidArgument, "period must be a positive duration not longer than the cache duration %s", s.cacheDuration)
+	}
 	metadata.period = period
 
+	if minWindowStr := scaledObject.ScalerMetadata["minWindow"]; minWindowStr != "" {
+		minWindow, err := time.ParseDuration(minWindowStr)
+		if err != nil || minWindow <= 0 || minWindow > period {
+			klog.Errorf("scalerobject %s/%s minWindow %s is invalid", scaledObject.Namespace, scaledObject.Name, minWindowStr)
+			return nil, status.Error(codes.InvalidArgument, "minWindow must be a positive duration not longer than period")
+		}
+		metadata.minWindow = minWindow
+	}
+
+	if staleAfterStr := scaledObject.ScalerMetadata["staleAfter"]; staleAfterStr != "" {
+		staleAfter, err := time.ParseDuration(staleAfterStr)
+		if err != nil || staleAfter <= 0 {
+			klog.Errorf("scalerobject %s/%s staleAfter %s is invalid", scaledObject.Namespace, scaledObject.Name, staleAfterStr)
+			return nil, status.Error(codes.InvalidArgument, "staleAfter must be a positive duration")
+		}
+		metadata.staleAfter = staleAfter
+	}
+
+	if activationStr := scaledObject.ScalerMetadata["activationQps"]; activationStr != "" {
+		activation, err := strconv.ParseFloat(activationStr, 64)
+		if err != nil || activation < 0 || math.IsInf(activation, 0) {
+			klog.Errorf("scalerobject %s/%s activationQps %s is invalid", scaledObject.Namespace, scaledObject.Name, activationStr)
+			return nil, status.Error(codes.InvalidArgument, "activationQps must be a non-negative number")
+		}
+		metadata.activationQps = activation
+	}
+
+	metadata.heartbeat = DefaultHeartbeat
+	if heartbeatStr := scaledObject.ScalerMetadata["heartbeat"]; heartbeatStr != "" {
+		heartbeat, err := time.ParseDuration(heartbeatStr)
+		if err != nil || heartbeat <= 0 {
+			klog.Errorf("scalerobject %s/%s heartbeat %s is invalid", scaledObject.Namespace, scaledObject.Name, heartbeatStr)
+			return nil, status.Error(codes.InvalidArgument, "heartbeat must be a positive duration")
+		}
+		metadata.heartbeat = heartbeat
+	}
+
+	metricStr := scaledObject.ScalerMetadata["metric"]
+	if metricStr == "" {
+		metricStr = MetricTypeQPS
+	}
+
+	// every metric of the list is parsed on its own, as the meaning of some
+	// keys like statusClass depends on it
+	var metrics []*IngressNginxScalerMetadata
+	for _, name := range strings.Split(metricStr, ",") {
+		metric := *metadata
+		metric.metric = strings.TrimSpace(name)
+		if err := parseMetricMetadata(scaledObject, &metric); err != nil {
+			return nil, err
+		}
+		if err := parseAggregationMetadata(scaledObject, &metric); err != nil {
+			return nil, err
+		}
+		if err := parseFilterMetadata(scaledObject, &metric); err != nil {
+			return nil, err
+		}
+
+		for _, other := range metrics {
+			if other.metricName() == metric.metricName() {
+				klog.Errorf("scalerobject %s/%s metric %s is specified twice", scaledObject.Namespace, scaledObject.Name, metric.metric)
+				return nil, status.Errorf(codes.InvalidArgument, "metric %s is specified twice", metric.metric)
+			}
+		}
+		metrics = append(metrics, &metric)
+	}
+	metadata = metrics[0]
+	metadata.metrics = metrics
+
+	metadata.ingressClass = scaledObject.ScalerMetadata["ingressClass"]
+	if err := s.resolveIngresses(scaledObject, metadata); err != nil {
+		return nil, err
+	}
+
+	for _, metric := range metrics {
+		metric.ingressClass, metric.ingresses = metadata.ingressClass, metadata.ingresses
+		for _, ingress := range metric.ingresses {
+			s.registerFilter(ingressKey(metric.namespace, ingress.name), metric.filter)
+			s.registerFilter(ingressKey(metric.namespace, ingress.name), metric.errorFilter)
+		}
+	}
+
+	return metadata, nil
+}
+
+// parseMetricMetadata parses the keys specific to the metric of metadata.
+func parseMetricMetadata(scaledObject *pb.ScaledObjectRef, metadata *IngressNginxScalerMetadata) error {
+	switch metadata.metric {
+	case MetricTypeQPS:
+		return parseQPSMetadata(scaledObject, metadata)
+	case MetricTypeLatency, MetricTypeUpstreamLatency:
+		return parseLatencyMetadata(scaledObject, metadata)
+	case MetricTypeErrorRatio, MetricTypeErrorRate:
+		return parseErrorMetadata(scaledObject, metadata)
+	case MetricTypeConcurrency:
+		return parseTarget(scaledObject, metadata, "targetConcurrency")
+	case MetricTypeBytes:
+		return parseBytesMetadata(scaledObject, metadata)
+	case MetricTypeConnections:
+		return parseConnectionsMetadata(scaledObject, metadata)
+	case MetricTypeFormula:
+		return parseFormulaMetadata(scaledObject, metadata)
+	}
+
+	klog.Errorf("scalerobject %s/%s metric %s is not supported", scaledObject.Namespace, scaledObject.Name, metadata.metric)
+	return status.Errorf(codes.InvalidArgument, "metric must be one of %s, %s, %s, %s, %s, %s, %s, %s, %s",
+		MetricTypeQPS, MetricTypeLatency, MetricTypeUpstreamLatency, MetricTypeErrorRatio, MetricTypeErrorRate,
+		MetricTypeConcurrency, MetricTypeBytes, MetricTypeConnections, MetricTypeFormula)
+}
+
+// resolveIngresses looks up the ingresses of the trigger, named by either
+// ingressName, the comma separated ingressNames or the label selector
+// ingressSelector. Ingresses selected by label are resolved anew on every
+// call, so the set follows ingresses being created, labeled and deleted.
+func (s *IngressNginxScaler) resolveIngresses(scaledObject *pb.ScaledObjectRef, metadata *IngressNginxScalerMetadata) error {
+	var names []string
+	var selector labels.Selector
+	specified := 0
+	if ingressName := scaledObject.ScalerMetadata["ingressName"]; ingressName != "" {
+		names = []string{ingressName}
+		specified++
+	}
+	if ingressNames := scaledObject.ScalerMetadata["ingressNames"]; ingressNames != "" {
+		// every ingress counts once however often it is named
+		seen := make(map[string]bool)
+		for _, name := range strings.Split(ingressNames, ",") {
+			if name = strings.TrimSpace(name); name != "" && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		specified++
+	}
+	if ingressSelector := scaledObject.ScalerMetadata["ingressSelector"]; ingressSelector != "" {
+		var err error
+		selector, err = labels.Parse(ingressSelector)
+		if err != nil {
+			klog.Errorf("scalerobject %s/%s ingressSelector %s is invalid: %v", scaledObject.Namespace, scaledObject.Name, ingressSelector, err)
+			return status.Errorf(codes.InvalidArgument, "ingressSelector is invalid: %v", err)
+		}
+		specified++
+	}
+	if specified != 1 || (selector == nil && len(names) == 0) {
+		klog.Errorf("scalerobject %s/%s exactly one of ingressName, ingressNames and ingressSelector must be specified", scaledObject.Namespace, scaledObject.Name)
+		return status.Error(codes.InvalidArgument, "exactly one of ingressName, ingressNames and ingressSelector must be specified and not empty")
+	}
+
+	// Ingresses named with an explicit ingress class and without a service
+	// or canary to resolve do not need to be looked up at all.
+	if selector == nil && metadata.ingressClass != "" && metadata.serviceName == "" && metadata.canary == "" {
+		for _, name := range names {
+			metadata.ingresses = append(metadata.ingresses, ingressTarget{
+				name:             name,
+				ingressClassGlob: fmt.Sprintf("%s-*", metadata.ingressClass),
+			})
+		}
+
+		return nil
+	}
+
+	if !s.ingressInformer.HasSynced() {
+		return status.Error(codes.Unavailable, "ingress cache is not synced yet")
+	}
+
+	var ingresses []*networkingv1.Ingress
+	if selector != nil {
+		var err error
+		ingresses, err = s.ingressLister.Ingresses(metadata.namespace).List(selector)
+		if err != nil {
+			klog.Errorf("scalerobject %s/%s list ingresses err: %v", metadata.namespace, metadata.name, err)
+			return status.Error(codes.Internal, err.Error())
+		}
+		if len(ingresses) == 0 {
+			klog.V(2).Infof("scalerobject %s/%s ingressSelector %s matches no ingress", metadata.namespace, metadata.name, selector)
+		}
+	}
+	for _, name := range names {
+		ingress, err := s.ingressLister.Ingresses(metadata.namespace).Get(name)
+		if apierrors.IsNotFound(err) {
+			klog.Errorf("scalerobject %s/%s ingress %s not found", metadata.namespace, metadata.name, name)
+			return status.Errorf(codes.NotFound, "ingress %s not found", name)
+		} else if err != nil {
+			klog.Errorf("scalerobject %s/%s get ingress err: %v", metadata.namespace, metadata.name, err)
+			return status.Error(codes.Internal, err.Error())
+		}
+		ingresses = append(ingresses, ingress)
+	}
+
+	ingresses, err := s.applyCanary(metadata, ingresses)
+	if err != nil {
+		return err
+	}
+
+	isBackend := false
+	for _, ingress := range ingresses {
+		if metadata.serviceName != "" && IsIngressBackend(ingress, metadata.serviceName) {
+			isBackend = true
+		}
+
+		ingressClass := metadata.ingressClass
+		if ingressClass == "" {
+			if ingress.Spec.IngressClassName != nil {
+				ingressClass = *ingress.Spec.IngressClassName
+			} else {
+				ingressClass = EmptyIngressClass
+			}
+		}
+
+		metadata.ingresses = append(metadata.ingresses, ingressTarget{
+			name:             ingress.Name,
+			ingressClassGlob: fmt.Sprintf("%s-*", ingressClass),
+		})
+	}
+
+	if metadata.serviceName != "" && len(ingresses) > 0 && !isBackend {
+		klog.Errorf("scalerobject %s/%s service %s is not a backend of its ingresses", metadata.namespace, metadata.name, metadata.serviceName)
+		return status.Errorf(codes.InvalidArgument, "service %s is not a backend of the selected ingresses", metadata.serviceName)
+	}
+
+	return nil
+}
+
+// applyCanary drops canary ingresses from ingresses if the trigger excludes
+// canary traffic, or adds the canary ingresses of the stable ones sharing a
+// host with them if it includes it.
+func (s *IngressNginxScaler) applyCanary(metadata *IngressNginxScalerMetadata, ingresses []*networkingv1.Ingress) ([]*networkingv1.Ingress, error) {
+	switch metadata.canary {
+	case CanaryExclude:
+		return slices.DeleteFunc(ingresses, IsCanaryIngress), nil
+	case CanaryInclude:
+		all, err := s.ingressLister.Ingresses(metadata.namespace).List(labels.Everything())
+		if err != nil {
+			klog.Errorf("scalerobject %s/%s list ingresses err: %v", metadata.namespace, metadata.name, err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		selected := make(map[string]bool, len(ingresses))
+		for _, ingress := range ingresses {
+			selected[ingress.Name] = true
+		}
+
+		stable := ingresses
+		for _, canary := range all {
+			if selected[canary.Name] || !IsCanaryIngress(canary) {
+				continue
+			}
+
+			for _, ingress := range stable {
+				if !IsCanaryIngress(ingress) && SharesHost(ingress, canary) {
+					klog.V(5).Infof("scalerobject %s/%s includes canary ingress %s of %s", metadata.namespace, metadata.name, canary.Name, ingress.Name)
+					ingresses = append(ingresses, canary)
+					selected[canary.Name] = true
+					break
+				}
+			}
+		}
+	}
+
+	return ingresses, nil
+}
+
+func parseQPSMetadata(scaledObject *pb.ScaledObjectRef, metadata *IngressNginxScalerMetadata) error {
 	qpsStr, ok := scaledObject.ScalerMetadata["qps"]
 	if !ok || qpsStr == "" {
 		klog.Errorf("scalerobject %s/%s qps must be specified", scaledObject.Namespace, scaledObject.Name)
-		return nil, status.Error(codes.InvalidArgument, "qps must be specified")
+		return status.Error(codes.InvalidArgument, "qps must be specified")
 	}
 
 	qps, err := strconv.ParseInt(qpsStr, 10, 64)
 	if err != nil {
 		klog.Errorf("scalerobject %s/%s qps %s is not an integer", scaledObject.Namespace, scaledObject.Name, qpsStr)
-		return nil, status.Error(codes.InvalidArgument, "qps must be an integer")
+		return status.Error(codes.InvalidArgument, "qps must be an integer")
 	}
 	metadata.qps = qps
 
-	ingressClass := scaledObject.ScalerMetadata["ingressClass"]
-	if ingressClass == "" {
-		ingress, err := s.clientset.NetworkingV1().Ingresses(metadata.namespace).Get(ctx, ingressName, metav1.GetOptions{})
+	return nil
+}
+
+func parseLatencyMetadata(scaledObject *pb.ScaledObjectRef, metadata *IngressNginxScalerMetadata) error {
+	metadata.quantile = DefaultQuantile
+	if quantileStr := scaledObject.ScalerMetadata["quantile"]; quantileStr == QuantileAverage {
+		metadata.average = true
+	} else if quantileStr != "" {
+		quantile, err := strconv.ParseFloat(quantileStr, 64)
+		if err != nil || quantile <= 0 || quantile > 1 {
+			klog.Errorf("scalerobject %s/%s quantile %s is invalid", scaledObject.Namespace, scaledObject.Name, quantileStr)
+			return status.Errorf(codes.InvalidArgument, "quantile must be a number in (0, 1] or %s", QuantileAverage)
+		}
+		metadata.quantile = quantile
+	}
+
+	targetLatencyStr, ok := scaledObject.ScalerMetadata["targetLatency"]
+	if !ok || targetLatencyStr == "" {
+		klog.Errorf("scalerobject %s/%s targetLatency must be specified", scaledObject.Namespace, scaledObject.Name)
+		return status.Error(codes.InvalidArgument, "targetLatency must be specified")
+	}
+
+	targetLatency, err := time.ParseDuration(targetLatencyStr)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if targetLatency <= 0 {
+		return status.Error(codes.InvalidArgument, "targetLatency must be positive")
+	}
+	metadata.target = targetLatency.Seconds()
+
+	return nil
+}
+
+func parseBytesMetadata(scaledObject *pb.ScaledObjectRef, metadata *IngressNginxScalerMetadata) error {
+	metadata.direction = scaledObject.ScalerMetadata["direction"]
+	switch metadata.direction {
+	case "":
+		metadata.direction = DirectionBoth
+	case DirectionIn, DirectionOut, DirectionBoth:
+	default:
+		klog.Errorf("scalerobject %s/%s direction %s is not supported", scaledObject.Namespace, scaledObject.Name, metadata.direction)
+		return status.Errorf(codes.InvalidArgument, "direction must be one of %s, %s, %s", DirectionIn, DirectionOut, DirectionBoth)
+	}
+
+	// accept quantities like 10Mi as well as plain numbers
+	targetStr, ok := scaledObject.ScalerMetadata["targetBytesPerSecond"]
+	if !ok || targetStr == "" {
+		klog.Errorf("scalerobject %s/%s targetBytesPerSecond must be specified", scaledObject.Namespace, scaledObject.Name)
+		return status.Error(codes.InvalidArgument, "targetBytesPerSecond must be specified")
+	}
+
+	target, err := resource.ParseQuantity(targetStr)
+	if err != nil || target.Sign() <= 0 {
+		klog.Errorf("scalerobject %s/%s targetBytesPerSecond %s is invalid", scaledObject.Namespace, scaledObject.Name, targetStr)
+		return status.Error(codes.InvalidArgument, "targetBytesPerSecond must be a positive quantity")
+	}
+	metadata.target = target.AsApproximateFloat64()
+
+	return nil
+}
+
+// parseConnectionsMetadata parses the connection state to track. The
+// connections gauge is exported per controller, so host, path and similar
+// filters do not apply.
+func parseConnectionsMetadata(scaledObject *pb.ScaledObjectRef, metadata *IngressNginxScalerMetadata) error {
+	metadata.connectionState = scaledObject.ScalerMetadata["connectionState"]
+	switch metadata.connectionState {
+	case "":
+		metadata.connectionState = ConnectionStateActive
+	case ConnectionStateActive, ConnectionStateReading, ConnectionStateWriting, ConnectionStateWaiting:
+	default:
+		klog.Errorf("scalerobject %s/%s connectionState %s is not supported", scaledObject.Namespace, scaledObject.Name, metadata.connectionState)
+		return status.Errorf(codes.InvalidArgument, "connectionState must be one of %s, %s, %s, %s",
+			ConnectionStateActive, ConnectionStateReading, ConnectionStateWriting, ConnectionStateWaiting)
+	}
+
+	if activationStr := scaledObject.ScalerMetadata["activationConnections"]; activationStr != "" {
+		activation, err := strconv.ParseFloat(activationStr, 64)
+		if err != nil || activation < 0 || math.IsInf(activation, 0) {
+			klog.Errorf("scalerobject %s/%s activationConnections %s is invalid", scaledObject.Namespace, scaledObject.Name, activationStr)
+			return status.Error(codes.InvalidArgument, "activationConnections must be a non-negative number")
+		}
+		metadata.activationConnections = activation
+	}
+
+	return parseTarget(scaledObject, metadata, "targetConnections")
+}
+
+// parseAggregationMetadata parses how the rates of every scrape interval
+// within the period, or the samples of the connections gauge, are
+// aggregated: their average, maximum or a percentile like p90. Metrics that
+// are not rates of requests or bytes or connections ignore it.
+func parseAggregationMetadata(scaledObject *pb.ScaledObjectRef, metadata *IngressNginxScalerMetadata) error {
+	switch metadata.metric {
+	case MetricTypeQPS, MetricTypeErrorRate, MetricTypeBytes, MetricTypeConnections:
+	default:
+		return nil
+	}
+
+	metadata.aggregation = scaledObject.ScalerMetadata["aggregation"]
+	if metadata.aggregation == "" {
+		metadata.aggregation = AggregationAvg
+	}
+	if _, ok := percentile(metadata.aggregation, "p"); ok {
+		return nil
+	}
+	if metadata.aggregation != AggregationAvg && metadata.aggregation != AggregationMax {
+		klog.Errorf("scalerobject %s/%s aggregation %s is not supported", scaledObject.Namespace, scaledObject.Name, metadata.aggregation)
+		return status.Errorf(codes.InvalidArgument, "aggregation must be one of %s, %s or a percentile like p90", AggregationAvg, AggregationMax)
+	}
+
+	return nil
+}
+
+// parseFormulaMetadata parses the formula and its target value. Unknown
+// variables and functions are rejected here rather than when evaluating.
+func parseFormulaMetadata(scaledObject *pb.ScaledObjectRef, metadata *IngressNginxScalerMetadata) error {
+	formulaStr := scaledObject.ScalerMetadata["formula"]
+	if formulaStr == "" {
+		klog.Errorf("scalerobject %s/%s formula must be specified", scaledObject.Namespace, scaledObject.Name)
+		return status.Error(codes.InvalidArgument, "formula must be specified")
+	}
+
+	formula, variables, err := parseFormula(formulaStr, func(name string) bool {
+		_, ok := metadata.formulaQuery(name)
+		return ok
+	})
+	if err != nil {
+		klog.Errorf("scalerobject %s/%s formula %q is invalid: %v", scaledObject.Namespace, scaledObject.Name, formulaStr, err)
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	metadata.formula = formula
+	metadata.formulaVariables = variables
+
+	return parseTarget(scaledObject, metadata, "targetValue")
+}
+
+// parseTarget parses the positive number under key as the target value of
+// the metric.
+func parseTarget(scaledObject *pb.ScaledObjectRef, metadata *IngressNginxScalerMetadata, key string) error {
+	targetStr, ok := scaledObject.ScalerMetadata[key]
+	if !ok || targetStr == "" {
+		klog.Errorf("scalerobject %s/%s %s must be specified", scaledObject.Namespace, scaledObject.Name, key)
+		return status.Errorf(codes.InvalidArgument, "%s must be specified", key)
+	}
+
+	target, err := strconv.ParseFloat(targetStr, 64)
+	if err != nil || target <= 0 || math.IsInf(target, 0) {
+		klog.Errorf("scalerobject %s/%s %s %s is invalid", scaledObject.Namespace, scaledObject.Name, key, targetStr)
+		return status.Errorf(codes.InvalidArgument, "%s must be a positive number", key)
+	}
+	metadata.target = target
+
+	return nil
+}
+
+// parseFilterMetadata builds the series filter from the host, path, method
+// and statusClass metadata. For the error metrics statusClass does not
+// restrict the requests that are looked at, it selects which of them are
+// errors and defaults to 5xx.
+func parseFilterMetadata(scaledObject *pb.ScaledObjectRef, metadata *IngressNginxScalerMetadata) error {
+	isErrorMetric := metadata.metric == MetricTypeErrorRatio || metadata.metric == MetricTypeErrorRate ||
+		metadata.metric == MetricTypeFormula
+	for key, label := range FilterLabels {
+		pattern := scaledObject.ScalerMetadata[key]
+		if label == StatusClassLabel && isErrorMetric {
+			continue
+		}
+		if pattern == "" {
+			continue
+		}
+
+		filter, err := metadata.filter.with(label, pattern)
 		if err != nil {
-			klog.Errorf("scalerobject %s/%s get ingress err: %v", metadata.namespace, metadata.name, err)
-			return nil, status.Error(codes.Internal, err.Error())
+			klog.Errorf("scalerobject %s/%s %s is invalid: %v", scaledObject.Namespace, scaledObject.Name, key, err)
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		metadata.filter = filter
+	}
+
+	if serviceName := scaledObject.ScalerMetadata["serviceName"]; serviceName != "" {
+		if errs := validation.IsDNS1035Label(serviceName); len(errs) > 0 {
+			klog.Errorf("scalerobject %s/%s serviceName %s is invalid: %v", scaledObject.Namespace, scaledObject.Name, serviceName, errs)
+			return status.Errorf(codes.InvalidArgument, "serviceName %s is invalid: %s", serviceName, strings.Join(errs, ", "))
 		}
 
-		if ingress.Spec.IngressClassName != nil {
-			ingressClass = *ingress.Spec.IngressClassName
-		} else {
-			ingressClass = EmptyIngressClass
+		// a valid service name holds no pattern characters, so this matches
+		// the service label exactly
+		filter, err := metadata.filter.with("service", serviceName)
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
 		}
+		metadata.filter = filter
+		metadata.serviceName = serviceName
 	}
-	metadata.ingressClass = ingressClass
-	metadata.ingressClassGlob = fmt.Sprintf("%s-*", ingressClass)
 
-	return metadata, nil
+	switch canary := scaledObject.ScalerMetadata["canary"]; canary {
+	case "":
+	case CanaryInclude:
+		metadata.canary = canary
+	case CanaryExclude:
+		// ingress-nginx reports requests routed to a canary backend with
+		// its name in the canary label, also under the stable ingress
+		filter, err := metadata.filter.with("canary", "")
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		metadata.filter = filter
+		metadata.canary = canary
+	default:
+		klog.Errorf("scalerobject %s/%s canary %s is not supported", scaledObject.Namespace, scaledObject.Name, canary)
+		return status.Errorf(codes.InvalidArgument, "canary must be one of %s, %s", CanaryInclude, CanaryExclude)
+	}
+
+	if !isErrorMetric {
+		return nil
+	}
+
+	statusClass := scaledObject.ScalerMetadata["statusClass"]
+	if statusClass == "" {
+		statusClass = DefaultStatusClass
+	}
+
+	errorFilter, err := metadata.filter.with(StatusClassLabel, statusClass)
+	if err != nil {
+		klog.Errorf("scalerobject %s/%s statusClass is invalid: %v", scaledObject.Namespace, scaledObject.Name, err)
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	metadata.errorFilter = errorFilter
+
+	return nil
+}
+
+func parseErrorMetadata(scaledObject *pb.ScaledObjectRef, metadata *IngressNginxScalerMetadata) error {
+	if metadata.metric == MetricTypeErrorRate {
+		return parseTarget(scaledObject, metadata, "targetErrorRate")
+	}
+
+	if err := parseTarget(scaledObject, metadata, "targetErrorRatio"); err != nil {
+		return err
+	}
+	if metadata.target > 1 {
+		return status.Error(codes.InvalidArgument, "targetErrorRatio must not be greater than 1")
+	}
+
+	return nil
 }
 
 const (
-	MetricsName       string = "nginx_ingress_controller_requests"
-	EmptyIngressClass string = "nginx_ingress_empty"
+	MetricsName                string = "nginx_ingress_controller_requests"
+	RequestDurationMetricsName string = "nginx_ingress_controller_request_duration_seconds"
+	RequestSizeMetricsName     string = "nginx_ingress_controller_request_size"
+	ResponseSizeMetricsName    string = "nginx_ingress_controller_response_size"
+	// ResponseDurationMetricsName is the time spent waiting for the
+	// upstream, UpstreamLatencyMetricsName the summary older controllers
+	// export instead.
+	ResponseDurationMetricsName string = "nginx_ingress_controller_response_duration_seconds"
+	UpstreamLatencyMetricsName  string = "nginx_ingress_controller_ingress_upstream_latency_seconds"
+	ConnectionsMetricsName      string = "nginx_ingress_controller_nginx_process_connections"
+	EmptyIngressClass           string = "nginx_ingress_empty"
+
+	MetricTypeQPS             string = "qps"
+	MetricTypeLatency         string = "latency"
+	MetricTypeUpstreamLatency string = "upstreamLatency"
+	MetricTypeErrorRatio      string = "errorRatio"
+	MetricTypeErrorRate       string = "errorRate"
+	MetricTypeConcurrency     string = "concurrency"
+	MetricTypeBytes           string = "bytes"
+	MetricTypeConnections     string = "connections"
+	MetricTypeFormula         string = "formula"
+
+	DirectionIn   string = "in"
+	DirectionOut  string = "out"
+	DirectionBoth string = "both"
+
+	CanaryInclude string = "include"
+	CanaryExclude string = "exclude"
+
+	QuantileAverage string = "avg"
+
+	AggregationAvg string = "avg"
+	AggregationMax string = "max"
+
+	ConnectionStateActive  string = "active"
+	ConnectionStateReading string = "reading"
+	ConnectionStateWriting string = "writing"
+	ConnectionStateWaiting string = "waiting"
+
+	DefaultQuantile    float64       = 0.95
+	DefaultStatusClass string        = "5xx"
+	DefaultHeartbeat   time.Duration = time.Minute
 )
 
 type IngressNginxScaler struct {
 	clientset kubernetes.Interface
 	watcher   utils.MetricsAddrWatcher
 
+	ingressInformer cache.SharedIndexInformer
+	ingressLister   networkingv1listers.IngressLister
+
 	cacheDuration time.Duration
 	interval      time.Duration
-	metricsCache  map[string]*utils.CounterCache
+	// scrapes fetches the metrics of every controller once per interval
+	// for all the caches.
+	scrapes      *utils.ScrapeManager
+	metricsCache map[string]*utils.CounterCache
+
+	// filters holds the series filters of all known triggers by ingress
+	// key and index.
+	filters map[string]map[string]seriesFilter
+	mu      sync.RWMutex
+
+	// ingressUpdates notifies about ingresses being added, changed or
+	// deleted.
+	ingressUpdates utils.Notifier
 }
 
 func NewIngressNginxScaler(clientset kubernetes.Interface, watcher utils.MetricsAddrWatcher, interval time.Duration, cacheDuration time.Duration) *IngressNginxScaler {
-	return &IngressNginxScaler{
-		clientset:     clientset,
-		watcher:       watcher,
-		interval:      interval,
-		cacheDuration: cacheDuration,
-		metricsCache:  make(map[string]*utils.CounterCache),
+	factory := informers.NewSharedInformerFactory(clientset, time.Minute)
+	ingresses := factory.Networking().V1().Ingresses()
+
+	s := &IngressNginxScaler{
+		clientset:       clientset,
+		watcher:         watcher,
+		ingressInformer: ingresses.Informer(),
+		ingressLister:   ingresses.Lister(),
+		interval:        interval,
+		cacheDuration:   cacheDuration,
+		scrapes:         utils.NewScrapeManager(interval),
+		metricsCache:    make(map[string]*utils.CounterCache),
+		filters:         make(map[string]map[string]seriesFilter),
 	}
+
+	s.scrapes.KeepLabels(indexLabels...)
+
+	_, _ = s.ingressInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) { s.ingressUpdates.Notify() },
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			// skip the periodic resyncs
+			if oldObj.(*networkingv1.Ingress).ResourceVersion != newObj.(*networkingv1.Ingress).ResourceVersion {
+				s.ingressUpdates.Notify()
+			}
+		},
+		DeleteFunc: func(obj interface{}) { s.ingressUpdates.Notify() },
+	})
+
+	return s
+}
+
+// SetScrapeOptions sets how the controllers are scraped.
+func (s *IngressNginxScaler) SetScrapeOptions(options utils.ScrapeOptions) {
+	s.scrapes.SetScrapeOptions(options)
+}
+
+// SetScrapeConfigFunc sets the function that decides how the controller at
+// an address is scraped, e.g. MetricsEndpoints.Config.
+func (s *IngressNginxScaler) SetScrapeConfigFunc(f func(addr string) *utils.ScrapeConfig) {
+	s.scrapes.SetConfigFunc(f)
 }
 
-func (s *IngressNginxScaler) getMetricsCache(globString string) *utils.CounterCache {
-	if cache, ok := s.metricsCache[globString]; ok {
-		return cache
+func (s *IngressNginxScaler) Run(stopCh <-chan struct{}) {
+	go s.scrapes.Run(stopCh)
+
+	klog.V(2).Info("Starting ingress informer in scaler")
+	s.ingressInformer.Run(stopCh)
+}
+
+// ingressKey identifies an ingress across namespaces, the ingress label of
+// ingress-nginx metrics alone is ambiguous.
+func ingressKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// registerFilter makes the caches account the series of the ingress
+// identified by key selected by filter under their own index from now on.
+func (s *IngressNginxScaler) registerFilter(key string, filter seriesFilter) {
+	index := filter.index(key)
+	if index == key {
+		return
 	}
 
-	watchCh := s.watcher.WatchByGlob(globString)
-	cache := utils.NewCounterCache(MetricsName, s.interval, s.cacheDuration, watchCh)
-	cache.SetIndexFunc(func(labels model.Metric) string {
-		return string(labels["ingress"])
-	})
-	s.metricsCache[globString] = cache
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	go cache.Run()
+	filters, ok := s.filters[key]
+	if !ok {
+		filters = make(map[string]seriesFilter)
+		s.filters[key] = filters
+	}
+	if _, ok := filters[index]; ok {
+		return
+	}
+
+	klog.V(4).Infof("Registering series filter %s", index)
+	filters[index] = filter
+	for _, cache := range s.metricsCache {
+		cache.Watch(index)
+	}
+}
+
+// indexLabels are the labels index and the series filters look at, the
+// scrapes drop all others. The status class is derived from status.
+var indexLabels = []model.LabelName{
+	"namespace", "ingress", "state", "host", "path", "method", "status", "service", "canary",
+}
+
+// index accounts every series under its namespaced ingress, and
+// additionally under every registered filter of that ingress it matches.
+// The connections of the controllers are not attributed to ingresses, they
+// are accounted under their state.
+func (s *IngressNginxScaler) index(labels model.Metric) []string {
+	if string(labels[model.MetricNameLabel]) == ConnectionsMetricsName {
+		return []string{string(labels["state"])}
+	}
+
+	key := ingressKey(string(labels["namespace"]), string(labels["ingress"]))
+	indexes := []string{key}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for index, filter := range s.filters[key] {
+		if filter.matches(labels) {
+			indexes = append(indexes, index)
+		}
+	}
+
+	return indexes
+}
+
+// getMetricsCache returns the cache of the controllers matching globString,
+// making sure it keeps the family name.
+func (s *IngressNginxScaler) getMetricsCache(name string, globString string) *utils.CounterCache {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cache, ok := s.metricsCache[globString]
+	if !ok {
+		watchCh := s.watcher.WatchByGlob(globString)
+		cache = utils.NewCounterCache(globString, s.interval, s.cacheDuration, watchCh)
+		cache.SetIndexFunc(s.index)
+		s.metricsCache[globString] = cache
+		s.scrapes.Register(cache)
+
+		go cache.Run()
+	}
+
+	cache.AddFamily(name)
 	return cache
 }
 
@@ -134,9 +1009,7 @@ func (s *IngressNginxScaler) IsActive(ctx context.Context, scaledObject *pb.Scal
 		return nil, err
 	}
 
-	cache := s.getMetricsCache(metadata.ingressClassGlob)
-
-	if !cache.IsActive(metadata.ingressName, metadata.period) {
+	if !s.isTriggerActive(metadata) {
 		return &pb.IsActiveResponse{
 			Result: false,
 		}, nil
@@ -146,31 +1019,119 @@ func (s *IngressNginxScaler) IsActive(ctx context.Context, scaledObject *pb.Scal
 		Result: true,
 	}, nil
 }
+
+// StreamIsActive pushes the activation state of the trigger when it
+// changes, as evaluated after every scrape of the caches it reads from, and
+// repeats it every heartbeat. The metadata is parsed again whenever an
+// ingress changes, so triggers follow their ingresses being relabeled or
+// moved to another class.
 func (s *IngressNginxScaler) StreamIsActive(scaledObject *pb.ScaledObjectRef, epsServer pb.ExternalScaler_StreamIsActiveServer) error {
 	klog.V(6).Infof("StreamIsActive called, scaledObject: %s/%s", scaledObject.Namespace, scaledObject.Name)
-	metadata, err := s.parseIngressNginxScalerMetadata(epsServer.Context(), scaledObject)
+	ctx := epsServer.Context()
+	metadata, err := s.parseIngressNginxScalerMetadata(ctx, scaledObject)
 	if err != nil {
 		return err
 	}
 
+	ingressUpdates, cancelIngressUpdates := s.ingressUpdates.Subscribe()
+	defer cancelIngressUpdates()
+	updates, cancelUpdates := s.subscribe(metadata)
+	defer func() { cancelUpdates() }()
+	heartbeat := time.NewTicker(metadata.heartbeat)
+	defer heartbeat.Stop()
+
+	send := func(result bool) error {
+		if err := epsServer.Send(&pb.IsActiveResponse{Result: result}); err != nil {
+			klog.Errorf("scalerobject %s/%s send isActiveResponse err: %v", scaledObject.Namespace, scaledObject.Name, err)
+			return err
+		}
+
+		return nil
+	}
+
+	active := s.isTriggerActive(metadata)
+	if err := send(active); err != nil {
+		return err
+	}
+
 	for {
 		select {
-		case <-epsServer.Context().Done():
+		case <-ctx.Done():
 			// call cancelled
 			return nil
-		case <-time.Tick(time.Minute):
-			cache := s.getMetricsCache(metadata.ingressClassGlob)
-			result := cache.IsActive(metadata.ingressClassGlob, metadata.period)
-
-			if err = epsServer.Send(&pb.IsActiveResponse{
-				Result: result,
-			}); err != nil {
-				klog.Errorf("scalerobject %s/%s send isActiveResponse err: %v", scaledObject.Namespace, scaledObject.Name, err)
+		case <-heartbeat.C:
+			if err := send(active); err != nil {
+				return err
+			}
+			continue
+		case <-ingressUpdates:
+			updated, err := s.parseIngressNginxScalerMetadata(ctx, scaledObject)
+			if err != nil {
+				// keep going with what was known to be valid
+				klog.Errorf("scalerobject %s/%s parse metadata after ingress update err: %v", scaledObject.Namespace, scaledObject.Name, err)
+				continue
+			}
+
+			metadata = updated
+			cancelUpdates()
+			updates, cancelUpdates = s.subscribe(metadata)
+			heartbeat.Reset(metadata.heartbeat)
+		case <-updates:
+		}
+
+		if result := s.isTriggerActive(metadata); result != active {
+			klog.V(4).Infof("scalerobject %s/%s active: %t", scaledObject.Namespace, scaledObject.Name, result)
+			active = result
+			if err := send(active); err != nil {
+				return err
 			}
 		}
 	}
 }
 
+// subscribe returns a channel that receives after every scrape of the
+// caches the metrics of the trigger are read from, and a function that
+// stops the subscription.
+func (s *IngressNginxScaler) subscribe(metadata *IngressNginxScalerMetadata) (<-chan struct{}, func()) {
+	caches := make(map[string]*utils.CounterCache)
+	for _, metric := range metadata.metrics {
+		for _, glob := range metric.ingressClassGlobs() {
+			for _, family := range metric.activationFamilies() {
+				caches[glob] = s.getMetricsCache(family, glob)
+			}
+		}
+	}
+
+	updates := make(chan struct{}, 1)
+	done := make(chan struct{})
+	cancels := make([]func(), 0, len(caches))
+	for _, cache := range caches {
+		ch, cancel := cache.Subscribe()
+		cancels = append(cancels, cancel)
+
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case <-ch:
+					select {
+					case updates <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}()
+	}
+
+	return updates, func() {
+		close(done)
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}
+}
+
 func (s *IngressNginxScaler) GetMetricSpec(ctx context.Context, scaledObject *pb.ScaledObjectRef) (*pb.GetMetricSpecResponse, error) {
 	klog.V(6).Infof("GetMetricSpec called, scaledObject: %s/%s", scaledObject.Namespace, scaledObject.Name)
 
@@ -179,13 +1140,28 @@ func (s *IngressNginxScaler) GetMetricSpec(ctx context.Context, scaledObject *pb
 		return nil, err
 	}
 
-	_ = s.getMetricsCache(metadata.ingressClassGlob)
+	specs := make([]*pb.MetricSpec, 0, len(metadata.metrics))
+	for _, metric := range metadata.metrics {
+		// activation may read other families than the metric itself
+		for _, ingress := range metric.ingresses {
+			for _, family := range append(metric.metricFamilies(), metric.activationFamilies()...) {
+				_ = s.getMetricsCache(family, ingress.ingressClassGlob)
+			}
+		}
+
+		spec := &pb.MetricSpec{
+			MetricName: metric.metricName(),
+		}
+		if metric.metric == MetricTypeQPS {
+			spec.TargetSize = metric.qps
+		} else {
+			spec.TargetSizeFloat = metric.target
+		}
+		specs = append(specs, spec)
+	}
 
 	return &pb.GetMetricSpecResponse{
-		MetricSpecs: []*pb.MetricSpec{{
-			MetricName: "ingress-nginx-qps",
-			TargetSize: metadata.qps,
-		}},
+		MetricSpecs: specs,
 	}, nil
 }
 
@@ -198,26 +1174,36 @@ func (s *IngressNginxScaler) GetMetrics(ctx context.Context, metricRequest *pb.G
 		return nil, err
 	}
 
-	cache := s.getMetricsCache(metadata.ingressClassGlob)
+	// answer for the requested metric only, or for all of them if the
+	// request does not name one
+	var values []*pb.MetricValue
+	for _, metric := range metadata.metrics {
+		if metricRequest.MetricName != "" && metricRequest.MetricName != metric.metricName() {
+			continue
+		}
 
-	latest, err := cache.GetLatest(metadata.ingressName)
-	if err != nil {
-		klog.Errorf("scalerobject %s/%s get latest metrics cache err: %v", scaledObject.Namespace, scaledObject.Name, err)
-		return nil, status.Error(codes.Internal, err.Error())
+		value, err := s.metricValue(metric)
+		if errors.Is(err, utils.ErrNotCovered) || errors.Is(err, utils.ErrStale) {
+			klog.V(2).Infof("scalerobject %s/%s get %s from metrics cache err: %v", scaledObject.Namespace, scaledObject.Name, metric.metric, err)
+			return nil, status.Error(codes.Unavailable, err.Error())
+		} else if err != nil {
+			klog.Errorf("scalerobject %s/%s get %s from metrics cache err: %v", scaledObject.Namespace, scaledObject.Name, metric.metric, err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		klog.V(5).Infof("scalerobject %s/%s %s: %f", scaledObject.Namespace, scaledObject.Name, metric.metric, value)
+		values = append(values, &pb.MetricValue{
+			MetricName:       metric.metricName(),
+			MetricValueFloat: value,
+		})
 	}
 
-	before, err := cache.GetBefore(metadata.ingressName, metadata.period)
-	if err != nil {
-		klog.Errorf("scalerobject %s/%s get before metrics cache err: %v", scaledObject.Namespace, scaledObject.Name, err)
-		return nil, status.Error(codes.Internal, err.Error())
+	if len(values) == 0 {
+		klog.Errorf("scalerobject %s/%s has no metric %s", scaledObject.Namespace, scaledObject.Name, metricRequest.MetricName)
+		return nil, status.Errorf(codes.NotFound, "metric %s not found", metricRequest.MetricName)
 	}
 
-	qps := (latest - before) / metadata.period.Seconds()
-	klog.V(5).Infof("scalerobject %s/%s qps: %f, latest: %f, before: %f", scaledObject.Namespace, scaledObject.Name, qps, latest, before)
 	return &pb.GetMetricsResponse{
-		MetricValues: []*pb.MetricValue{{
-			MetricName:       "ingress-nginx-qps",
-			MetricValueFloat: qps,
-		}},
+		MetricValues: values,
 	}, nil
 }
@@ -0,0 +1,540 @@
+package scaler
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	pb "github.com/dovics/keda-ingress-nginx-scaler/pkg/api"
+)
+
+// testWatcher hands the controllers at addrs to every cache.
+type testWatcher struct{ addrs []string }
+
+func (w testWatcher) WatchByGlob(glob string) chan []string {
+	ch := make(chan []string, 1)
+	if w.addrs != nil {
+		ch <- w.addrs
+	}
+	return ch
+}
+
+func (testWatcher) StopWatchByGlob(glob string) {}
+
+func newTestScaler(t *testing.T, objects ...runtime.Object) *IngressNginxScaler {
+	t.Helper()
+
+	s := NewIngressNginxScaler(fake.NewClientset(objects...), testWatcher{}, time.Second, time.Minute)
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+
+	go s.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, s.ingressInformer.HasSynced) {
+		t.Fatal("Failed to sync ingress informer")
+	}
+
+	return s
+}
+
+func newTestIngress(namespace, name string, services ...string) *networkingv1.Ingress {
+	ingressClass := "nginx"
+	ingress := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec: networkingv1.IngressSpec{
+			IngressClassName: &ingressClass,
+			Rules:            []networkingv1.IngressRule{{}},
+		},
+	}
+
+	ingress.Spec.Rules[0].HTTP = &networkingv1.HTTPIngressRuleValue{}
+	for _, service := range services {
+		ingress.Spec.Rules[0].HTTP.Paths = append(ingress.Spec.Rules[0].HTTP.Paths, networkingv1.HTTPIngressPath{
+			Path: "/" + service,
+			Backend: networkingv1.IngressBackend{
+				Service: &networkingv1.IngressServiceBackend{Name: service},
+			},
+		})
+	}
+
+	return ingress
+}
+
+func TestIngressNginxScalerIndex(t *testing.T) {
+	s := NewIngressNginxScaler(nil, nil, time.Second, time.Minute)
+	s.registerFilter(ingressKey("team-a", "web"), mustFilter(t, "path", "/api/*"))
+
+	indexes := s.index(model.Metric{"namespace": "team-a", "ingress": "web", "path": "/api/v1"})
+	expected := []string{"team-a/web", `team-a/web{path="/api/*"}`}
+	if !slices.Equal(indexes, expected) {
+		t.Errorf("Expected indexes %v, got %v", expected, indexes)
+	}
+
+	// an ingress of the same name in another namespace is kept apart and
+	// does not match the filters of the first one
+	indexes = s.index(model.Metric{"namespace": "team-b", "ingress": "web", "path": "/api/v1"})
+	expected = []string{"team-b/web"}
+	if !slices.Equal(indexes, expected) {
+		t.Errorf("Expected indexes %v, got %v", expected, indexes)
+	}
+
+	// the scrapes must not drop the labels the filters match on
+	for _, label := range FilterLabels {
+		if label == StatusClassLabel {
+			label = "status"
+		}
+		if !slices.Contains(indexLabels, label) {
+			t.Errorf("Expected label %s to be kept", label)
+		}
+	}
+}
+
+func TestParseServiceName(t *testing.T) {
+	s := newTestScaler(t, newTestIngress("default", "web", "frontend", "api"))
+
+	scaledObject := &pb.ScaledObjectRef{
+		Namespace: "default",
+		Name:      "api",
+		ScalerMetadata: map[string]string{
+			"ingressName": "web",
+			"serviceName": "api",
+			"period":      "30s",
+			"qps":         "10",
+		},
+	}
+
+	metadata, err := s.parseIngressNginxScalerMetadata(context.Background(), scaledObject)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if index := metadata.filter.index(ingressKey("default", "web")); index != `default/web{service="api"}` {
+		t.Errorf("Expected the index to be restricted to the service, got %s", index)
+	}
+	if metadata.ingresses[0].ingressClassGlob != "nginx-*" {
+		t.Errorf("Expected ingress class glob nginx-*, got %s", metadata.ingresses[0].ingressClassGlob)
+	}
+
+	scaledObject.ScalerMetadata["serviceName"] = "backend"
+	if _, err := s.parseIngressNginxScalerMetadata(context.Background(), scaledObject); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for a service that is not a backend, got %v", err)
+	}
+}
+
+func TestParseIngressSelector(t *testing.T) {
+	public := newTestIngress("default", "public", "web")
+	public.Labels = map[string]string{"app": "web"}
+	internal := newTestIngress("default", "internal", "web")
+	internal.Labels = map[string]string{"app": "web"}
+	other := newTestIngress("other", "public", "web")
+	other.Labels = map[string]string{"app": "web"}
+	s := newTestScaler(t, public, internal, other, newTestIngress("default", "api", "api"))
+
+	scaledObject := &pb.ScaledObjectRef{
+		Namespace: "default",
+		Name:      "web",
+		ScalerMetadata: map[string]string{
+			"ingressSelector": "app=web",
+			"period":          "30s",
+			"qps":             "10",
+		},
+	}
+
+	metadata, err := s.parseIngressNginxScalerMetadata(context.Background(), scaledObject)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var names []string
+	for _, ingress := range metadata.ingresses {
+		names = append(names, ingress.name)
+	}
+	slices.Sort(names)
+	if !slices.Equal(names, []string{"internal", "public"}) {
+		t.Errorf("Expected the selector to match internal and public, got %v", names)
+	}
+
+	scaledObject.ScalerMetadata["ingressNames"] = "public, api"
+	if _, err := s.parseIngressNginxScalerMetadata(context.Background(), scaledObject); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument when both ingressNames and ingressSelector are set, got %v", err)
+	}
+
+	delete(scaledObject.ScalerMetadata, "ingressSelector")
+	metadata, err = s.parseIngressNginxScalerMetadata(context.Background(), scaledObject)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(metadata.ingresses) != 2 || metadata.ingresses[0].name != "public" || metadata.ingresses[1].name != "api" {
+		t.Errorf("Expected ingresses public and api, got %v", metadata.ingresses)
+	}
+
+	scaledObject.ScalerMetadata["ingressNames"] = "public, api,public"
+	metadata, err = s.parseIngressNginxScalerMetadata(context.Background(), scaledObject)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(metadata.ingresses) != 2 {
+		t.Errorf("Expected a repeated ingress to count once, got %v", metadata.ingresses)
+	}
+
+	scaledObject.ScalerMetadata["ingressNames"] = "public,missing"
+	if _, err := s.parseIngressNginxScalerMetadata(context.Background(), scaledObject); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound for a missing ingress, got %v", err)
+	}
+}
+
+func TestParseCanary(t *testing.T) {
+	stable := newTestIngress("default", "web", "web")
+	stable.Spec.Rules[0].Host = "web.example.com"
+	canary := newTestIngress("default", "web-canary", "web-canary")
+	canary.Spec.Rules[0].Host = "web.example.com"
+	canary.Annotations = map[string]string{CanaryAnnotation: "true"}
+	other := newTestIngress("default", "api-canary", "api-canary")
+	other.Spec.Rules[0].Host = "api.example.com"
+	other.Annotations = map[string]string{CanaryAnnotation: "true"}
+	s := newTestScaler(t, stable, canary, other)
+
+	scaledObject := &pb.ScaledObjectRef{
+		Namespace: "default",
+		Name:      "web",
+		ScalerMetadata: map[string]string{
+			"ingressNames": "web",
+			"canary":       "include",
+			"period":       "30s",
+			"qps":          "10",
+		},
+	}
+
+	metadata, err := s.parseIngressNginxScalerMetadata(context.Background(), scaledObject)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(metadata.ingresses) != 2 || metadata.ingresses[1].name != "web-canary" {
+		t.Errorf("Expected the canary of web to be folded in, got %v", metadata.ingresses)
+	}
+
+	scaledObject.ScalerMetadata["ingressNames"] = "web,web-canary"
+	scaledObject.ScalerMetadata["canary"] = "exclude"
+	metadata, err = s.parseIngressNginxScalerMetadata(context.Background(), scaledObject)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(metadata.ingresses) != 1 || metadata.ingresses[0].name != "web" {
+		t.Errorf("Expected the canary ingress to be excluded, got %v", metadata.ingresses)
+	}
+	if metadata.filter.matches(model.Metric{"canary": "default-web-canary-80"}) {
+		t.Error("Expected requests routed to the canary backend to be excluded")
+	}
+
+	scaledObject.ScalerMetadata["canary"] = "only"
+	if _, err := s.parseIngressNginxScalerMetadata(context.Background(), scaledObject); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for an unknown canary mode, got %v", err)
+	}
+}
+
+func TestGetMetricSpec(t *testing.T) {
+	s := newTestScaler(t, newTestIngress("default", "web", "web"))
+
+	tests := []struct {
+		metadata map[string]string
+		name     string
+		target   float64
+	}{
+		{map[string]string{"qps": "10"}, "ingress-nginx-qps", 10},
+		{map[string]string{"qps": "10", "aggregation": "p99"}, "ingress-nginx-qps", 10},
+		{map[string]string{"metric": "latency", "targetLatency": "250ms"}, "ingress-nginx-latency", 0.25},
+		{map[string]string{"metric": "upstreamLatency", "quantile": "avg", "targetLatency": "100ms"}, "ingress-nginx-upstream-latency", 0.1},
+		{map[string]string{"metric": "connections", "aggregation": "max", "targetConnections": "1000"}, "ingress-nginx-active-connections", 1000},
+		{map[string]string{"metric": "errorRatio", "targetErrorRatio": "0.05"}, "ingress-nginx-error-ratio", 0.05},
+		{map[string]string{"metric": "errorRate", "targetErrorRate": "2"}, "ingress-nginx-error-rate", 2},
+		{map[string]string{"metric": "concurrency", "targetConcurrency": "50"}, "ingress-nginx-concurrency", 50},
+		{map[string]string{"metric": "bytes", "direction": "out", "targetBytesPerSecond": "10Mi"}, "ingress-nginx-bytes", 10 << 20},
+		{map[string]string{"metric": "formula", "formula": "max(qps/100, p95/0.2)", "targetValue": "1"}, "ingress-nginx-formula", 1},
+	}
+
+	for _, test := range tests {
+		test.metadata["ingressName"] = "web"
+		test.metadata["period"] = "30s"
+		resp, err := s.GetMetricSpec(context.Background(), &pb.ScaledObjectRef{
+			Namespace:      "default",
+			Name:           "web",
+			ScalerMetadata: test.metadata,
+		})
+		if err != nil {
+			t.Fatalf("Expected no error for %s, got %v", test.name, err)
+		}
+
+		spec := resp.MetricSpecs[0]
+		target := spec.TargetSizeFloat
+		if spec.TargetSize != 0 {
+			target = float64(spec.TargetSize)
+		}
+		if spec.MetricName != test.name || target != test.target {
+			t.Errorf("Expected spec %s with target %f, got %s with %f", test.name, test.target, spec.MetricName, target)
+		}
+	}
+
+	_, err := s.GetMetricSpec(context.Background(), &pb.ScaledObjectRef{
+		Namespace:      "default",
+		Name:           "web",
+		ScalerMetadata: map[string]string{"ingressName": "web", "period": "30s", "metric": "concurrency"},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument without targetConcurrency, got %v", err)
+	}
+
+	_, err = s.GetMetricSpec(context.Background(), &pb.ScaledObjectRef{
+		Namespace:      "default",
+		Name:           "web",
+		ScalerMetadata: map[string]string{"ingressName": "web", "period": "30s", "qps": "10", "aggregation": "median"},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for an unknown aggregation, got %v", err)
+	}
+}
+
+func TestParseFormula(t *testing.T) {
+	s := newTestScaler(t, newTestIngress("default", "web", "web"))
+
+	scaledObject := &pb.ScaledObjectRef{
+		Namespace: "default",
+		Name:      "web",
+		ScalerMetadata: map[string]string{
+			"ingressName": "web",
+			"period":      "30s",
+			"metric":      "formula",
+			"formula":     "qps * (1 + errorRate*4) + upstreamP99",
+			"targetValue": "100",
+		},
+	}
+
+	metadata, err := s.parseIngressNginxScalerMetadata(context.Background(), scaledObject)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !slices.Equal(metadata.formulaVariables, []string{"qps", "errorRate", "upstreamP99"}) {
+		t.Errorf("Expected variables qps, errorRate and upstreamP99, got %v", metadata.formulaVariables)
+	}
+	if !slices.Equal(metadata.metricFamilies(), []string{MetricsName, ResponseDurationMetricsName, UpstreamLatencyMetricsName}) {
+		t.Errorf("Expected the families of all sub-queries, got %v", metadata.metricFamilies())
+	}
+
+	if !slices.Equal(metadata.activationFamilies(), []string{MetricsName}) {
+		t.Errorf("Expected activation to read the request rate, got %v", metadata.activationFamilies())
+	}
+
+	query, _ := metadata.formulaQuery("upstreamP99")
+	if query.metric != MetricTypeUpstreamLatency || query.quantile != 0.99 || query.average {
+		t.Errorf("Expected upstreamP99 to be the 0.99 upstream latency quantile, got %s %f", query.metric, query.quantile)
+	}
+
+	// connections do not need the request rate to activate
+	scaledObject.ScalerMetadata["formula"] = "connections / 100"
+	if metadata, err = s.parseIngressNginxScalerMetadata(context.Background(), scaledObject); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !slices.Equal(metadata.activationFamilies(), []string{ConnectionsMetricsName}) {
+		t.Errorf("Expected activation to read the connections only, got %v", metadata.activationFamilies())
+	}
+
+	for _, formula := range []string{"", "qps +", "qps * rps", "sqrt(qps)", "max()", "abs(qps, p95)", "p5", "(qps"} {
+		scaledObject.ScalerMetadata["formula"] = formula
+		if _, err := s.parseIngressNginxScalerMetadata(context.Background(), scaledObject); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected InvalidArgument for formula %q, got %v", formula, err)
+		}
+	}
+}
+
+func TestMultipleMetrics(t *testing.T) {
+	s := newTestScaler(t, newTestIngress("default", "web", "web"))
+
+	scaledObject := &pb.ScaledObjectRef{
+		Namespace: "default",
+		Name:      "web",
+		ScalerMetadata: map[string]string{
+			"ingressName":   "web",
+			"period":        "30s",
+			"metric":        "qps, latency",
+			"qps":           "10",
+			"quantile":      "0.99",
+			"targetLatency": "200ms",
+		},
+	}
+
+	resp, err := s.GetMetricSpec(context.Background(), scaledObject)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(resp.MetricSpecs) != 2 ||
+		resp.MetricSpecs[0].MetricName != "ingress-nginx-qps" || resp.MetricSpecs[0].TargetSize != 10 ||
+		resp.MetricSpecs[1].MetricName != "ingress-nginx-latency" || resp.MetricSpecs[1].TargetSizeFloat != 0.2 {
+		t.Errorf("Expected qps and latency specs, got %v", resp.MetricSpecs)
+	}
+
+	_, err = s.GetMetrics(context.Background(), &pb.GetMetricsRequest{
+		ScaledObjectRef: scaledObject,
+		MetricName:      "ingress-nginx-error-ratio",
+	})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound for a metric the trigger does not have, got %v", err)
+	}
+
+	scaledObject.ScalerMetadata["metric"] = "qps,qps"
+	if _, err := s.GetMetricSpec(context.Background(), scaledObject); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for a metric specified twice, got %v", err)
+	}
+}
+
+func TestParseActivationQps(t *testing.T) {
+	s := newTestScaler(t, newTestIngress("default", "web", "web"))
+
+	scaledObject := &pb.ScaledObjectRef{
+		Namespace: "default",
+		Name:      "web",
+		ScalerMetadata: map[string]string{
+			"ingressName":   "web",
+			"period":        "30s",
+			"qps":           "10",
+			"activationQps": "0.5",
+		},
+	}
+
+	metadata, err := s.parseIngressNginxScalerMetadata(context.Background(), scaledObject)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if metadata.activationQps != 0.5 {
+		t.Errorf("Expected activationQps 0.5, got %f", metadata.activationQps)
+	}
+
+	// the caches do not cover the period yet
+	resp, err := s.IsActive(context.Background(), scaledObject)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if resp.Result {
+		t.Error("Expected the trigger not to be active without traffic")
+	}
+
+	for _, activation := range []string{"-1", "fast"} {
+		scaledObject.ScalerMetadata["activationQps"] = activation
+		if _, err := s.parseIngressNginxScalerMetadata(context.Background(), scaledObject); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected InvalidArgument for activationQps %s, got %v", activation, err)
+		}
+	}
+
+	delete(scaledObject.ScalerMetadata, "activationQps")
+	scaledObject.ScalerMetadata["metric"] = MetricTypeConnections
+	scaledObject.ScalerMetadata["targetConnections"] = "100"
+	for _, activation := range []string{"-1", "many"} {
+		scaledObject.ScalerMetadata["activationConnections"] = activation
+		if _, err := s.parseIngressNginxScalerMetadata(context.Background(), scaledObject); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected InvalidArgument for activationConnections %s, got %v", activation, err)
+		}
+	}
+}
+
+type testStream struct {
+	grpc.ServerStream
+	ctx       context.Context
+	responses chan *pb.IsActiveResponse
+}
+
+func (s *testStream) Context() context.Context { return s.ctx }
+
+func (s *testStream) Send(resp *pb.IsActiveResponse) error {
+	s.responses <- resp
+	return nil
+}
+
+func TestStreamIsActive(t *testing.T) {
+	s := newTestScaler(t, newTestIngress("default", "web", "web"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &testStream{ctx: ctx, responses: make(chan *pb.IsActiveResponse, 10)}
+	scaledObject := &pb.ScaledObjectRef{
+		Namespace: "default",
+		Name:      "web",
+		ScalerMetadata: map[string]string{
+			"ingressName": "web",
+			"period":      "30s",
+			"qps":         "10",
+			"heartbeat":   "50ms",
+		},
+	}
+
+	errCh := make(chan error)
+	go func() { errCh <- s.StreamIsActive(scaledObject, stream) }()
+
+	// the initial state is pushed right away and repeated every heartbeat
+	for i := 0; i < 2; i++ {
+		select {
+		case resp := <-stream.responses:
+			if resp.Result {
+				t.Error("Expected the trigger not to be active without traffic")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected the state to be pushed")
+		}
+	}
+
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Errorf("Expected no error after the stream was cancelled, got %v", err)
+	}
+
+	scaledObject.ScalerMetadata["heartbeat"] = "0s"
+	if err := s.StreamIsActive(scaledObject, stream); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for a zero heartbeat, got %v", err)
+	}
+}
+
+func TestGetMetricsWithoutData(t *testing.T) {
+	s := newTestScaler(t, newTestIngress("default", "web", "web"))
+
+	scaledObject := &pb.ScaledObjectRef{
+		Namespace: "default",
+		Name:      "web",
+		ScalerMetadata: map[string]string{
+			"ingressName": "web",
+			"period":      "30s",
+			"qps":         "10",
+			"minWindow":   "5s",
+		},
+	}
+
+	// without any data there is no usable window at all
+	_, err := s.GetMetrics(context.Background(), &pb.GetMetricsRequest{ScaledObjectRef: scaledObject})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected Unavailable without any data, got %v", err)
+	}
+
+	scaledObject.ScalerMetadata["minWindow"] = "1m"
+	if _, err := s.parseIngressNginxScalerMetadata(context.Background(), scaledObject); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for a minWindow longer than period, got %v", err)
+	}
+
+	delete(scaledObject.ScalerMetadata, "minWindow")
+	for _, period := range []string{"0s", "-30s", "2m"} {
+		scaledObject.ScalerMetadata["period"] = period
+		if _, err := s.parseIngressNginxScalerMetadata(context.Background(), scaledObject); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected InvalidArgument for period %s with a cache duration of 1m, got %v", period, err)
+		}
+	}
+	scaledObject.ScalerMetadata["period"] = "30s"
+
+	scaledObject.ScalerMetadata["minWindow"] = "5s"
+	scaledObject.ScalerMetadata["staleAfter"] = "-1s"
+	if _, err := s.parseIngressNginxScalerMetadata(context.Background(), scaledObject); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for a negative staleAfter, got %v", err)
+	}
+}
@@ -1,17 +1,47 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
-	"net/http"
+	"maps"
+	"math"
+	"slices"
 	"sync"
 	"time"
 
-	io_prometheus_client "github.com/prometheus/client_model/go"
-	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/common/model"
 	"k8s.io/klog/v2"
 )
 
+// seriesKey identifies a single series scraped from a single
+// controller pod. Counters are only comparable with earlier values of the
+// same series, so resets and pod churn are tracked at this granularity.
+type seriesKey struct {
+	addr        string
+	fingerprint model.Fingerprint
+}
+
+// Snapshot holds the values of every series of one family under one index
+// as they were scraped at Timestamp, from the fraction Coverage of the
+// controllers that could be reached.
+type Snapshot struct {
+	Timestamp time.Time
+	Coverage  float64
+	Values    map[seriesKey]Sample
+}
+
+var (
+	// ErrNotCovered is returned when the cache has not been collecting for
+	// long enough to answer a query.
+	ErrNotCovered = errors.New("cache does not cover the window yet")
+	// ErrStale is returned when the cache has not been able to scrape any
+	// controller for too long.
+	ErrStale = errors.New("cached metrics are stale")
+)
+
+// CounterCache keeps the history of the samples of every family added to it
+// by family and index, as scraped by a ScrapeManager from the controllers at
+// the addresses it receives.
 type CounterCache struct {
 	name     string
 	internal time.Duration
@@ -20,13 +50,25 @@ type CounterCache struct {
 	addrs  []string
 	addrCh chan []string
 
-	parser expfmt.TextParser
-
 	cacheSize int
-	cache     map[string]*Ring[float64]
-	mu        sync.RWMutex
-
-	indexFunc func(model.Metric) string
+	cache     map[string]map[string]*Ring[Snapshot]
+	started   time.Time
+	since     map[string]time.Time
+	// lastScrape is the time of the last successful scrape, controllers
+	// the number of controllers the last scrape tried, coverage the
+	// fraction of them it reached and failing the ones it did not.
+	lastScrape  time.Time
+	controllers int
+	coverage    float64
+	failing     map[string]bool
+	// families maps the cached families to the time they were added at,
+	// zero if that was before the first scrape.
+	families map[string]time.Time
+	mu       sync.RWMutex
+
+	indexFunc func(model.Metric) []string
+
+	updates Notifier
 }
 
 func NewCounterCache(name string, internal time.Duration, period time.Duration, addrCh chan []string) *CounterCache {
@@ -41,165 +83,500 @@ func NewCounterCache(name string, internal time.Duration, period time.Duration,
 		internal: internal,
 		period:   period,
 		addrCh:   addrCh,
-		parser:   expfmt.TextParser{},
 
 		cacheSize: cacheSize,
 
-		cache: make(map[string]*Ring[float64]),
+		cache:    make(map[string]map[string]*Ring[Snapshot]),
+		since:    make(map[string]time.Time),
+		families: make(map[string]time.Time),
+		coverage: 1,
 	}
 }
 
-func (c *CounterCache) SetIndexFunc(f func(model.Metric) string) {
+// AddFamily makes the cache keep the samples of the family name from the
+// next scrape on.
+func (c *CounterCache) AddFamily(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.families[name]; ok {
+		return
+	}
+
+	klog.V(4).Infof("Adding family %s to counter cache %s", name, c.name)
+	var added time.Time
+	if !c.started.IsZero() {
+		added = time.Now()
+	}
+	c.families[name] = added
+}
+
+// Subscribe returns a channel that receives after every scrape, successful
+// or not, and a function that stops the subscription.
+func (c *CounterCache) Subscribe() (<-chan struct{}, func()) {
+	return c.updates.Subscribe()
+}
+
+// SetIndexFunc sets the function that decides which indexes a series is
+// accounted under. A series may belong to several indexes, or to none.
+func (c *CounterCache) SetIndexFunc(f func(model.Metric) []string) {
 	c.indexFunc = f
 }
 
+// Watch tells the cache that series are only accounted under index from now
+// on, e.g. because the index function just started to produce it, so that
+// queries on index are not answered before it had the time to fill up.
+func (c *CounterCache) Watch(index string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.since[index]; !ok && !c.started.IsZero() {
+		c.since[index] = time.Now()
+	}
+}
+
+// Run keeps track of the addresses of the controllers the cache is fed
+// with until the channel of addresses is closed.
 func (c *CounterCache) Run() {
-	ticker := time.NewTicker(c.internal)
-	klog.V(4).Infof("Starting counter cache for %s with period %s", c.name, c.internal)
-	for {
-		select {
-		case <-ticker.C:
-			totalData := make(map[string]float64)
-			for _, addr := range c.addrs {
-				klog.V(6).Infof("Fetching metrics from %s", addr)
-				data, err := c.FetchMetrics(addr)
-				if err != nil {
-					continue
-				}
+	for addrs := range c.addrCh {
+		c.mu.Lock()
+		c.addrs = addrs
+		c.mu.Unlock()
+	}
 
-				for name, sample := range data {
-					totalData[name] += sample
-				}
+	klog.Warning("CounterCache channel closed")
+}
+
+// targets returns the addresses of the controllers the cache is fed with.
+func (c *CounterCache) targets() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.addrs
+}
+
+// familyNames returns the names of the cached families.
+func (c *CounterCache) familyNames() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return slices.Collect(maps.Keys(c.families))
+}
+
+// collect indexes the series scraped from addrs, the controllers the cache
+// was fed with when the scrape started, and keeps them as the snapshot
+// taken at now. Controllers in failing could not be reached.
+func (c *CounterCache) collect(now time.Time, addrs []string, scraped map[string][]scrapedSeries, failing map[string]bool) {
+	c.mu.RLock()
+	families := maps.Clone(c.families)
+	c.mu.RUnlock()
+
+	failed := make(map[string]bool)
+	totalData := make(map[string]map[string]map[seriesKey]Sample)
+	for _, addr := range addrs {
+		if failing[addr] {
+			failed[addr] = true
+			continue
+		}
+
+		for _, series := range scraped[addr] {
+			name := string(series.labels[model.MetricNameLabel])
+			if _, ok := families[name]; !ok {
+				continue
 			}
 
-			c.mu.Lock()
-			for name, samples := range totalData {
-				r, ok := c.cache[name]
+			indexes := []string{series.labels.String()}
+			if c.indexFunc != nil {
+				indexes = c.indexFunc(series.labels)
+			}
+
+			family, ok := totalData[name]
+			if !ok {
+				family = make(map[string]map[seriesKey]Sample)
+				totalData[name] = family
+			}
+			for _, index := range indexes {
+				snapshot, ok := family[index]
 				if !ok {
-					klog.V(4).Infof("Creating new ring buffer %s", name)
-					r = NewRing[float64](int(c.period / c.internal))
-					c.cache[name] = r
+					snapshot = make(map[seriesKey]Sample)
+					family[index] = snapshot
 				}
-
-				klog.V(8).Infof("Adding %f to ring buffer %s", samples, name)
-				r.Enqueue(samples)
+				snapshot[seriesKey{addr: addr, fingerprint: series.fingerprint}] = series.sample
 			}
-			c.mu.Unlock()
+		}
+	}
+
+	c.record(len(addrs), failed)
+	if len(failed) < len(addrs) {
+		c.enqueue(now, totalData)
+	} else if len(addrs) > 0 {
+		klog.Warningf("Failed to scrape any of %d controllers for %s", len(addrs), c.name)
+	}
+	c.updates.Notify()
+}
+
+// record keeps track of how many of targets controllers a scrape reached.
+func (c *CounterCache) record(targets int, failing map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-		case addrs, ok := <-c.addrCh:
+	c.controllers = targets
+	c.coverage = 1
+	if targets > 0 {
+		c.coverage = float64(targets-len(failing)) / float64(targets)
+	}
+	if len(failing) > 0 {
+		klog.V(4).Infof("Scraped %d of %d controllers for %s", targets-len(failing), targets, c.name)
+	}
+	c.failing = failing
+}
+
+func (c *CounterCache) enqueue(now time.Time, totalData map[string]map[string]map[seriesKey]Sample) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.started.IsZero() {
+		c.started = now
+	}
+	c.lastScrape = now
+
+	for name, family := range totalData {
+		rings, ok := c.cache[name]
+		if !ok {
+			rings = make(map[string]*Ring[Snapshot])
+			c.cache[name] = rings
+		}
+
+		for index, snapshot := range family {
+			r, ok := rings[index]
 			if !ok {
-				klog.Warning("CounterCache channel closed")
-				return
+				klog.V(4).Infof("Creating new ring buffer %s %s", name, index)
+				// One extra slot so that a full period can be looked back on.
+				r = NewRing[Snapshot](c.cacheSize + 1)
+				rings[index] = r
 			}
 
-			c.addrs = addrs
+			klog.V(8).Infof("Adding %d series to ring buffer %s %s", len(snapshot), name, index)
+			r.Enqueue(Snapshot{Timestamp: now, Coverage: c.coverage, Values: snapshot})
 		}
 	}
 }
 
-func (c *CounterCache) FetchMetrics(url string) (map[string]float64, error) {
-	resp, err := http.Get(url)
-	if err != nil {
-		klog.Errorf("Failed to fetch metrics from %s: %v", url, err)
-		return nil, err
+// Increase returns the PromQL increase() of the family name under index over
+// the last beforeTime, or ErrNotCovered if the cache has not collected it yet.
+func (c *CounterCache) Increase(name, index string, beforeTime time.Duration) (Sample, error) {
+	return c.increase(name, index, beforeTime, time.Now())
+}
+
+func (c *CounterCache) increase(name, index string, beforeTime time.Duration, now time.Time) (Sample, error) {
+	if beforeTime > c.period {
+		return Sample{}, fmt.Errorf("beforeTime %s is greater than period %s", beforeTime, c.period)
 	}
-	defer resp.Body.Close()
 
-	metricFamilies, err := c.parser.TextToMetricFamilies(resp.Body)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	start := now.Add(-beforeTime)
+	covered, err := c.covers(name, index, start)
 	if err != nil {
-		klog.Errorf("Failed to parse metrics from %s: %v", url, err)
-		return nil, err
+		return Sample{}, err
+	}
+	if !covered {
+		return Sample{}, fmt.Errorf("%w: %s", ErrNotCovered, beforeTime)
+	}
+
+	cache, ok := c.cache[name][index]
+	if !ok {
+		return Sample{}, nil
+	}
+
+	series := make(map[seriesKey][]point)
+	for _, snapshot := range c.window(cache, start, now) {
+		for key, sample := range snapshot.Values {
+			series[key] = append(series[key], point{timestamp: snapshot.Timestamp, sample: sample})
+		}
 	}
 
-	samples := make(map[string]float64)
-	for name, mf := range metricFamilies {
-		if name != c.name {
+	var increase Sample
+	seen := make(map[string]bool)
+	for key, points := range series {
+		increase = increase.Add(extrapolatedIncrease(points, start, now, c.failing[key.addr]))
+		seen[key.addr] = true
+	}
+
+	// failing controllers without any sample left in the window are assumed
+	// to serve as much as the others, like Rates and Totals do
+	var lost int
+	for addr := range c.failing {
+		if !seen[addr] {
+			lost++
+		}
+	}
+	if lost > 0 && lost < c.controllers {
+		increase = increase.Scale(float64(c.controllers) / float64(c.controllers-lost))
+	}
+
+	return increase, nil
+}
+
+// Rates returns the per second rate of the counters of the family name
+// under any of indexes for every pair of consecutive scrapes within the last
+// beforeTime, oldest first. Resets are compensated like in Increase, and a
+// series only contributes to the slices it was scraped at both ends of, or
+// at the end and some earlier scrape. For histograms the sum and every
+// bucket are rates alongside the sample count. The rates of scrapes that
+// only reached some of the controllers are scaled up to all of them.
+func (c *CounterCache) Rates(name string, indexes []string, beforeTime time.Duration) ([]Sample, error) {
+	return c.rates(name, indexes, beforeTime, time.Now())
+}
+
+func (c *CounterCache) rates(name string, indexes []string, beforeTime time.Duration, now time.Time) ([]Sample, error) {
+	if beforeTime > c.period {
+		return nil, fmt.Errorf("beforeTime %s is greater than period %s", beforeTime, c.period)
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	start := now.Add(-beforeTime)
+	merged := make(map[time.Time]map[seriesKey]Sample)
+	coverage := make(map[time.Time]float64)
+	for _, index := range indexes {
+		covered, err := c.covers(name, index, start)
+		if err != nil {
+			return nil, err
+		}
+		if !covered {
+			return nil, fmt.Errorf("%w: %s", ErrNotCovered, beforeTime)
+		}
+
+		cache, ok := c.cache[name][index]
+		if !ok {
 			continue
 		}
 
-		for _, m := range mf.Metric {
-			var labels model.Metric = model.Metric{
-				model.MetricNameLabel: model.LabelValue(name),
-			}
-			for _, lp := range m.Label {
-				labels[model.LabelName(lp.GetName())] = model.LabelValue(lp.GetValue())
+		for _, snapshot := range c.window(cache, start, now) {
+			values, ok := merged[snapshot.Timestamp]
+			if !ok {
+				values = make(map[seriesKey]Sample, len(snapshot.Values))
+				merged[snapshot.Timestamp] = values
 			}
+			maps.Copy(values, snapshot.Values)
+			coverage[snapshot.Timestamp] = snapshot.Coverage
+		}
+	}
 
-			// Extract value based on type
-			var value float64
-			switch mf.GetType() {
-			case io_prometheus_client.MetricType_COUNTER:
-				value = m.GetCounter().GetValue()
-			case io_prometheus_client.MetricType_GAUGE:
-				value = m.GetGauge().GetValue()
-			case io_prometheus_client.MetricType_UNTYPED:
-				value = m.GetUntyped().GetValue()
-			}
+	timestamps := slices.SortedFunc(maps.Keys(merged), time.Time.Compare)
+	if len(timestamps) < 2 {
+		return nil, nil
+	}
 
-			var index string
-			if c.indexFunc != nil {
-				index = c.indexFunc(labels)
-			} else {
-				index = labels.String()
-			}
+	seen := make(map[seriesKey]point)
+	for key, sample := range merged[timestamps[0]] {
+		seen[key] = point{timestamp: timestamps[0], sample: sample}
+	}
 
-			samples[index] = value
+	rates := make([]Sample, 0, len(timestamps)-1)
+	for _, timestamp := range timestamps[1:] {
+		var rate Sample
+		for key, sample := range merged[timestamp] {
+			if prev, ok := seen[key]; ok {
+				increase := sample.Sub(prev.sample)
+				if sample.Value < prev.sample.Value {
+					// The counter was reset, everything it holds now is new.
+					increase = sample
+				}
+				rate = rate.Add(increase.Scale(1 / timestamp.Sub(prev.timestamp).Seconds()))
+			}
+			seen[key] = point{timestamp: timestamp, sample: sample}
 		}
+		rates = append(rates, rate.Scale(1/coverage[timestamp]))
 	}
 
-	return samples, nil
+	return rates, nil
 }
 
-func (c *CounterCache) GetLatest(index string) (float64, error) {
+// Totals returns the sum of the values of all series of the family name
+// under index for every scrape within the last beforeTime, oldest first.
+// Unlike Increase it is meant for gauges. Scrapes that only reached some of
+// the controllers are scaled up to all of them.
+func (c *CounterCache) Totals(name, index string, beforeTime time.Duration) ([]float64, error) {
+	return c.totals(name, index, beforeTime, time.Now())
+}
+
+func (c *CounterCache) totals(name, index string, beforeTime time.Duration, now time.Time) ([]float64, error) {
+	if beforeTime > c.period {
+		return nil, fmt.Errorf("beforeTime %s is greater than period %s", beforeTime, c.period)
+	}
+
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	cache, ok := c.cache[index]
+	start := now.Add(-beforeTime)
+	covered, err := c.covers(name, index, start)
+	if err != nil {
+		return nil, err
+	}
+	if !covered {
+		return nil, fmt.Errorf("%w: %s", ErrNotCovered, beforeTime)
+	}
+
+	cache, ok := c.cache[name][index]
 	if !ok {
-		return 0, fmt.Errorf("index %s not found", index)
+		return nil, nil
 	}
 
-	return cache.GetLatest(), nil
+	snapshots := c.window(cache, start, now)
+	totals := make([]float64, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		var total float64
+		for _, sample := range snapshot.Values {
+			total += sample.Value
+		}
+		totals = append(totals, total/snapshot.Coverage)
+	}
+
+	return totals, nil
 }
 
-func (c *CounterCache) GetBefore(index string, beforeTime time.Duration) (float64, error) {
-	if beforeTime > c.period {
-		return 0, fmt.Errorf("beforeTime %s is greater than period %s", beforeTime, c.period)
+// covers reports whether the cache was already collecting the family name
+// under index at start, i.e. its first scrape happened no later than one
+// scrape interval after start. Rings created later than that belong to
+// series that did not exist before. It fails for families that are not
+// cached at all.
+func (c *CounterCache) covers(name, index string, start time.Time) (bool, error) {
+	since, err := c.collectingSince(name, index)
+	if err != nil {
+		return false, err
 	}
 
-	before := int(beforeTime / c.internal)
-	if beforeTime%c.internal != 0 {
-		klog.Warningf("beforeTime %s is not a multiple of internal %s", beforeTime, c.internal)
+	return !since.IsZero() && !since.After(start.Add(c.internal)), nil
+}
+
+// collectingSince returns when the cache started collecting the family name
+// under index, or the zero time if it has not scraped yet.
+func (c *CounterCache) collectingSince(name, index string) (time.Time, error) {
+	added, ok := c.families[name]
+	if !ok {
+		return time.Time{}, fmt.Errorf("family %s is not cached", name)
+	}
+
+	since, ok := c.since[index]
+	if !ok {
+		since = c.started
+	}
+	if added.After(since) {
+		since = added
 	}
 
+	return since, nil
+}
+
+// Covered returns for how long the cache has been collecting the family
+// name under index, which is zero before the first scrape and for families
+// that are not cached.
+func (c *CounterCache) Covered(name, index string) time.Duration {
+	return c.covered(name, index, time.Now())
+}
+
+func (c *CounterCache) covered(name, index string, now time.Time) time.Duration {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	cache, ok := c.cache[index]
-	if !ok {
-		return 0, fmt.Errorf("index %s not found", index)
+	since, err := c.collectingSince(name, index)
+	if err != nil || since.IsZero() {
+		return 0
 	}
 
-	if cache.Count() <= before {
-		return 0, fmt.Errorf("beforeTime %s is greater than cache size %d", beforeTime, cache.Count())
+	return now.Sub(since)
+}
+
+// LastScrape returns when the cache last scraped any controller
+// successfully, or the zero time if it never did.
+func (c *CounterCache) LastScrape() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.lastScrape
+}
+
+// Coverage returns the fraction of the controllers the last scrape reached.
+func (c *CounterCache) Coverage() float64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.coverage
+}
+
+// window returns the snapshots of the ring taken within [start, end], oldest
+// first.
+func (c *CounterCache) window(cache *Ring[Snapshot], start, end time.Time) []Snapshot {
+	var snapshots []Snapshot
+	for i := min(cache.Count(), cache.size) - 1; i >= 0; i-- {
+		snapshot := cache.GetBefore(i)
+		if snapshot.Timestamp.Before(start) || snapshot.Timestamp.After(end) {
+			continue
+		}
+
+		snapshots = append(snapshots, snapshot)
 	}
 
-	return cache.GetBefore(before), nil
+	return snapshots
 }
 
-func (c *CounterCache) IsActive(index string, beforeTime time.Duration) bool {
-	before := beforeTime / c.internal
-	if beforeTime%c.internal != 0 {
-		klog.Warningf("beforeTime %s is not a multiple of internal %s", beforeTime, c.internal)
+type point struct {
+	timestamp time.Time
+	sample    Sample
+}
+
+// extrapolatedIncrease mirrors the way Prometheus evaluates increase() on a
+// single counter series: resets are compensated, and the observed increase
+// is extrapolated towards start and end unless the series starts or stops
+// too far away from them, in which case only half a scrape interval is
+// assumed. A series that continues past its last sample, because its
+// controller could just not be reached, is extrapolated up to end in any
+// case. Resets and extrapolation are decided on Value, the rest of the
+// sample follows along.
+func extrapolatedIncrease(points []point, start, end time.Time, continues bool) Sample {
+	if len(points) < 2 {
+		return Sample{}
 	}
 
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+	first, last := points[0], points[len(points)-1]
+	result := last.sample.Sub(first.sample)
+	prev := first.sample
+	for _, p := range points[1:] {
+		if p.sample.Value < prev.Value {
+			// The counter was reset, everything it holds now is new.
+			result = result.Add(prev)
+		}
+		prev = p.sample
+	}
 
-	cache, ok := c.cache[index]
-	if !ok {
-		return false
+	sampledInterval := last.timestamp.Sub(first.timestamp).Seconds()
+	if sampledInterval <= 0 {
+		return Sample{}
+	}
+
+	averageDurationBetweenSamples := sampledInterval / float64(len(points)-1)
+	extrapolationThreshold := averageDurationBetweenSamples * 1.1
+
+	durationToStart := first.timestamp.Sub(start).Seconds()
+	if durationToStart >= extrapolationThreshold {
+		durationToStart = averageDurationBetweenSamples / 2
+	}
+	if result.Value > 0 && first.sample.Value >= 0 {
+		// Counters cannot go below zero, so do not extrapolate past the
+		// point where the series would have started.
+		durationToZero := sampledInterval * (first.sample.Value / result.Value)
+		durationToStart = math.Min(durationToStart, durationToZero)
+	}
+
+	durationToEnd := end.Sub(last.timestamp).Seconds()
+	if durationToEnd >= extrapolationThreshold && !continues {
+		durationToEnd = averageDurationBetweenSamples / 2
 	}
 
-	return cache.Count() > int(before)
+	extrapolateToInterval := sampledInterval + durationToStart + durationToEnd
+	return result.Scale(extrapolateToInterval / sampledInterval)
 }
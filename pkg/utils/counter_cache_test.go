@@ -0,0 +1,309 @@
+package utils
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"testing"
+	"time"
+)
+
+var testStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newTestCounterCache() *CounterCache {
+	cache := NewCounterCache("test", time.Second, 5*time.Second, make(chan []string))
+	cache.AddFamily("test")
+	return cache
+}
+
+// family wraps the snapshots of the indexes of the test family.
+func family(indexes map[string]map[seriesKey]Sample) map[string]map[string]map[seriesKey]Sample {
+	return map[string]map[string]map[seriesKey]Sample{"test": indexes}
+}
+
+func at(seconds float64) time.Time {
+	return testStart.Add(time.Duration(seconds * float64(time.Second)))
+}
+
+func expectIncrease(t *testing.T, cache *CounterCache, window time.Duration, now time.Time, expected float64) {
+	t.Helper()
+
+	increase, err := cache.increase("test", "web", window, now)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if math.Abs(increase.Value-expected) > 1e-9 {
+		t.Errorf("Expected increase to be %f, got %f", expected, increase.Value)
+	}
+}
+
+func TestCounterCacheIncrease(t *testing.T) {
+	cache := newTestCounterCache()
+	a := seriesKey{addr: "a", fingerprint: 1}
+	b := seriesKey{addr: "b", fingerprint: 1}
+
+	cache.enqueue(at(0), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 10}, b: {Value: 100}}}))
+	cache.enqueue(at(1), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 20}, b: {Value: 110}}}))
+	cache.enqueue(at(2), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 35}, b: {Value: 130}}}))
+
+	expectIncrease(t, cache, 2*time.Second, at(2), 55)
+	expectIncrease(t, cache, time.Second, at(2), 35)
+
+	if _, err := cache.increase("test", "web", 4*time.Second, at(2)); err == nil {
+		t.Error("Expected error when the cache does not cover the window")
+	}
+
+	increase, err := cache.increase("test", "api", time.Second, at(2))
+	if err != nil {
+		t.Fatalf("Expected no error for unknown index, got %v", err)
+	}
+	if increase.Value != 0 {
+		t.Errorf("Expected unknown index not to increase, got %f", increase.Value)
+	}
+}
+
+func TestCounterCacheIncreaseWithReset(t *testing.T) {
+	cache := newTestCounterCache()
+	a := seriesKey{addr: "a", fingerprint: 1}
+
+	cache.enqueue(at(0), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 1000}}}))
+	cache.enqueue(at(1), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 1010}}}))
+	// controller restarted and counts from zero again
+	cache.enqueue(at(2), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 5}}}))
+	cache.enqueue(at(3), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 25}}}))
+
+	expectIncrease(t, cache, 3*time.Second, at(3), 35)
+}
+
+func TestCounterCacheIncreaseWithChurn(t *testing.T) {
+	cache := newTestCounterCache()
+	a := seriesKey{addr: "a", fingerprint: 1}
+	b := seriesKey{addr: "b", fingerprint: 1}
+
+	cache.enqueue(at(0), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 100}}}))
+	cache.enqueue(at(1), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 110}, b: {Value: 500}}}))
+	// pod a left the address list
+	cache.enqueue(at(2), family(map[string]map[seriesKey]Sample{"web": {b: {Value: 520}}}))
+	cache.enqueue(at(3), family(map[string]map[seriesKey]Sample{"web": {b: {Value: 530}}}))
+
+	// a is only extrapolated by half an interval past its last sample, b is
+	// close enough to the start of the window to be extrapolated up to it
+	expectIncrease(t, cache, 3*time.Second, at(3), 15+45)
+}
+
+func TestCounterCacheIncreaseWithJitter(t *testing.T) {
+	cache := newTestCounterCache()
+	a := seriesKey{addr: "a", fingerprint: 1}
+
+	// a steady 10 requests per second scraped at uneven times
+	cache.enqueue(at(0), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 1000}}}))
+	cache.enqueue(at(1.5), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 1015}}}))
+	cache.enqueue(at(2), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 1020}}}))
+	cache.enqueue(at(4), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 1040}}}))
+
+	expectIncrease(t, cache, 4*time.Second, at(4), 40)
+	expectIncrease(t, cache, 2500*time.Millisecond, at(4), 25)
+}
+
+func TestCounterCacheFullPeriod(t *testing.T) {
+	cache := newTestCounterCache()
+	a := seriesKey{addr: "a", fingerprint: 1}
+
+	for i := 0; i <= 10; i++ {
+		cache.enqueue(at(float64(i)), family(map[string]map[seriesKey]Sample{"web": {a: {Value: float64(i * 10)}}}))
+	}
+
+	expectIncrease(t, cache, 5*time.Second, at(10), 50)
+}
+
+func TestCounterCacheHistogramIncrease(t *testing.T) {
+	cache := newTestCounterCache()
+	a := seriesKey{addr: "a", fingerprint: 1}
+
+	cache.enqueue(at(0), family(map[string]map[seriesKey]Sample{"web": {a: histogram(100, 10, 20, 30, 40, 50)}}))
+	cache.enqueue(at(1), family(map[string]map[seriesKey]Sample{"web": {a: histogram(110, 10, 25, 40, 50, 60)}}))
+	cache.enqueue(at(2), family(map[string]map[seriesKey]Sample{"web": {a: histogram(120, 10, 30, 50, 60, 70)}}))
+
+	increase, err := cache.increase("test", "web", 2*time.Second, at(2))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if increase.Value != 20 || increase.Sum != 20 {
+		t.Errorf("Expected count and sum increase of 20, got %f and %f", increase.Value, increase.Sum)
+	}
+	if q := increase.Quantile(0.5); q != 0.25 {
+		t.Errorf("Expected p50 to be 0.25, got %f", q)
+	}
+}
+
+func TestCounterCacheIncreaseOfLateIndex(t *testing.T) {
+	cache := newTestCounterCache()
+	a := seriesKey{addr: "a", fingerprint: 1}
+	b := seriesKey{addr: "a", fingerprint: 2}
+
+	cache.enqueue(at(0), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 10}}}))
+	cache.enqueue(at(1), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 20}}}))
+	// the first 5xx response shows up as a new series
+	cache.enqueue(at(2), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 30}, b: {Value: 1}}, "web/5xx": {b: {Value: 1}}}))
+	cache.enqueue(at(3), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 40}, b: {Value: 3}}, "web/5xx": {b: {Value: 3}}}))
+
+	increase, err := cache.increase("test", "web/5xx", 3*time.Second, at(3))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if increase.Value != 3 {
+		t.Errorf("Expected increase to be 3, got %f", increase.Value)
+	}
+}
+
+func TestCounterCacheTotals(t *testing.T) {
+	cache := newTestCounterCache()
+	a := seriesKey{addr: "a", fingerprint: 1}
+	b := seriesKey{addr: "b", fingerprint: 1}
+
+	cache.enqueue(at(0), family(map[string]map[seriesKey]Sample{"active": {a: {Value: 10}, b: {Value: 5}}}))
+	cache.enqueue(at(1), family(map[string]map[seriesKey]Sample{"active": {a: {Value: 20}, b: {Value: 5}}}))
+	cache.enqueue(at(2), family(map[string]map[seriesKey]Sample{"active": {a: {Value: 15}}}))
+
+	totals, err := cache.totals("test", "active", 2*time.Second, at(2))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !slices.Equal(totals, []float64{15, 25, 15}) {
+		t.Errorf("Expected totals [15 25 15], got %v", totals)
+	}
+
+	totals, err = cache.totals("test", "active", time.Second, at(2))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !slices.Equal(totals, []float64{25, 15}) {
+		t.Errorf("Expected totals [25 15], got %v", totals)
+	}
+}
+
+func TestCounterCacheFamilies(t *testing.T) {
+	cache := newTestCounterCache()
+	a := seriesKey{addr: "a", fingerprint: 1}
+
+	cache.enqueue(at(0), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 10}}}))
+	cache.enqueue(at(1), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 20}}}))
+
+	if _, err := cache.increase("other", "web", time.Second, at(1)); err == nil {
+		t.Error("Expected error for a family that is not cached")
+	}
+
+	// a family added after the first scrape only covers windows from then on
+	cache.AddFamily("other")
+	if _, err := cache.increase("other", "web", time.Second, at(1)); !errors.Is(err, ErrNotCovered) {
+		t.Errorf("Expected ErrNotCovered for a family added late, got %v", err)
+	}
+}
+
+func TestCounterCacheRates(t *testing.T) {
+	cache := newTestCounterCache()
+	a := seriesKey{addr: "a", fingerprint: 1}
+	b := seriesKey{addr: "a", fingerprint: 2}
+
+	cache.enqueue(at(0), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 10}}, "api": {b: {Value: 0}}}))
+	cache.enqueue(at(1), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 20}}, "api": {b: {Value: 5}}}))
+	// a burst on web, then its controller restarts
+	cache.enqueue(at(2), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 120}}, "api": {b: {Value: 10}}}))
+	cache.enqueue(at(4), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 40}}, "api": {b: {Value: 20}}}))
+
+	rates, err := cache.rates("test", []string{"web", "api"}, 4*time.Second, at(4))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var values []float64
+	for _, rate := range rates {
+		values = append(values, rate.Value)
+	}
+	if !slices.Equal(values, []float64{15, 105, 25}) {
+		t.Errorf("Expected rates [15 105 25], got %v", values)
+	}
+}
+
+func TestCounterCacheCovered(t *testing.T) {
+	cache := newTestCounterCache()
+	a := seriesKey{addr: "a", fingerprint: 1}
+
+	if covered := cache.covered("test", "web", at(0)); covered != 0 {
+		t.Errorf("Expected nothing to be covered before the first scrape, got %s", covered)
+	}
+
+	cache.enqueue(at(0), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 10}}}))
+	cache.enqueue(at(1), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 20}}}))
+	cache.enqueue(at(2), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 30}}}))
+
+	covered := cache.covered("test", "web", at(2))
+	if covered != 2*time.Second {
+		t.Errorf("Expected 2s to be covered, got %s", covered)
+	}
+
+	// the covered part of a longer window can be queried right away
+	expectIncrease(t, cache, covered, at(2), 20)
+
+	if !cache.LastScrape().Equal(at(2)) {
+		t.Errorf("Expected the last scrape at %s, got %s", at(2), cache.LastScrape())
+	}
+}
+
+func TestCounterCachePartialScrape(t *testing.T) {
+	cache := newTestCounterCache()
+	a := seriesKey{addr: "a", fingerprint: 1}
+	b := seriesKey{addr: "b", fingerprint: 1}
+
+	cache.record(2, nil)
+	cache.enqueue(at(0), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 0}, b: {Value: 100}}}))
+	cache.enqueue(at(1), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 10}, b: {Value: 110}}}))
+	// controller b cannot be reached anymore
+	cache.record(2, map[string]bool{"b": true})
+	cache.enqueue(at(2), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 20}}}))
+	cache.enqueue(at(3), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 30}}}))
+
+	if coverage := cache.Coverage(); coverage != 0.5 {
+		t.Errorf("Expected coverage 0.5, got %f", coverage)
+	}
+
+	// b is assumed to keep serving 10 requests per second
+	expectIncrease(t, cache, 3*time.Second, at(3), 30+30)
+
+	totals, err := cache.totals("test", "web", 3*time.Second, at(3))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !slices.Equal(totals, []float64{100, 120, 40, 60}) {
+		t.Errorf("Expected totals scaled up to all controllers, got %v", totals)
+	}
+}
+
+func TestCounterCacheLongOutage(t *testing.T) {
+	cache := newTestCounterCache()
+	a := seriesKey{addr: "a", fingerprint: 1}
+	b := seriesKey{addr: "b", fingerprint: 1}
+
+	cache.record(2, nil)
+	cache.enqueue(at(0), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 0}, b: {Value: 100}}}))
+	cache.enqueue(at(1), family(map[string]map[seriesKey]Sample{"web": {a: {Value: 50}, b: {Value: 150}}}))
+	// controller b stays down for longer than the period
+	cache.record(2, map[string]bool{"b": true})
+	for i := 2; i <= 8; i++ {
+		cache.enqueue(at(float64(i)), family(map[string]map[seriesKey]Sample{"web": {a: {Value: float64(50 * i)}}}))
+	}
+
+	// b is assumed to serve as much as a, like the rates assume
+	expectIncrease(t, cache, 5*time.Second, at(8), 2*250)
+
+	rates, err := cache.rates("test", []string{"web"}, 5*time.Second, at(8))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, rate := range rates {
+		if rate.Value != 100 {
+			t.Errorf("Expected rates of 100 from both controllers, got %v", rates)
+			break
+		}
+	}
+}
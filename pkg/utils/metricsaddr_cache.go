@@ -1,7 +1,9 @@
 package utils
 
 import (
+	"maps"
 	"path/filepath"
+	"slices"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
@@ -54,6 +56,7 @@ type MetricsAddrCache struct {
 
 	getIdentity    func(obj *corev1.Pod) (string, error)
 	getMetricsAddr func(obj *corev1.Pod) (string, error)
+	updateFunc     func(addrs []string)
 }
 
 func NewMetricsAddrCache(clientset *kubernetes.Clientset, labelSelector string, getIdentity, getMetricsAddr func(obj *corev1.Pod) (string, error)) *MetricsAddrCache {
@@ -77,6 +80,12 @@ func NewMetricsAddrCache(clientset *kubernetes.Clientset, labelSelector string,
 	}
 }
 
+// SetUpdateFunc sets the function called with the addresses of all cached
+// pods whenever a pod is added or removed. It must be set before Run.
+func (c *MetricsAddrCache) SetUpdateFunc(f func(addrs []string)) {
+	c.updateFunc = f
+}
+
 func (c *MetricsAddrCache) Run(stopCh <-chan struct{}) {
 	c.podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
@@ -121,6 +130,7 @@ func (c *MetricsAddrCache) addPod(pod *corev1.Pod) {
 	klog.V(4).Infof("Adding pod %s/%s with identity %s and address %s", pod.Namespace, pod.Name, identity, addr)
 	c.cache[identity] = addr
 
+	c.update()
 	c.triggerWatch(identity)
 }
 
@@ -134,6 +144,7 @@ func (c *MetricsAddrCache) removePod(pod *corev1.Pod) {
 	klog.V(4).Infof("Removing pod %s/%s from cache", pod.Namespace, pod.Name)
 	delete(c.cache, identity)
 
+	c.update()
 	c.triggerWatch(identity)
 }
 
@@ -174,6 +185,12 @@ func (c *MetricsAddrCache) StopWatchByGlob(glob string) {
 	delete(c.watchCh, glob)
 }
 
+func (c *MetricsAddrCache) update() {
+	if c.updateFunc != nil {
+		c.updateFunc(slices.Collect(maps.Values(c.cache)))
+	}
+}
+
 func (c *MetricsAddrCache) triggerWatch(identity string) {
 	for glob, ch := range c.watchCh {
 		if match, err := filepath.Match(glob, identity); match && err == nil {
@@ -0,0 +1,44 @@
+package utils
+
+import "sync"
+
+// Notifier wakes up its subscribers whenever Notify is called. Notifications
+// a subscriber has not picked up yet are coalesced, so Notify never blocks.
+// The zero value is ready to use.
+type Notifier struct {
+	mu          sync.Mutex
+	subscribers map[chan struct{}]struct{}
+}
+
+// Subscribe returns a channel that receives after every notification from
+// now on, and a function that stops the subscription.
+func (n *Notifier) Subscribe() (<-chan struct{}, func()) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.subscribers == nil {
+		n.subscribers = make(map[chan struct{}]struct{})
+	}
+
+	ch := make(chan struct{}, 1)
+	n.subscribers[ch] = struct{}{}
+
+	return ch, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+
+		delete(n.subscribers, ch)
+	}
+}
+
+func (n *Notifier) Notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for ch := range n.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
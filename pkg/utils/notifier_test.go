@@ -0,0 +1,39 @@
+package utils
+
+import "testing"
+
+func TestNotifier(t *testing.T) {
+	var n Notifier
+	a, cancelA := n.Subscribe()
+	b, cancelB := n.Subscribe()
+	defer cancelB()
+
+	// notifications that were not picked up yet are coalesced
+	n.Notify()
+	n.Notify()
+	for name, ch := range map[string]<-chan struct{}{"a": a, "b": b} {
+		select {
+		case <-ch:
+		default:
+			t.Errorf("Expected subscriber %s to be notified", name)
+		}
+		select {
+		case <-ch:
+			t.Errorf("Expected subscriber %s to be notified only once", name)
+		default:
+		}
+	}
+
+	cancelA()
+	n.Notify()
+	select {
+	case <-a:
+		t.Error("Expected no notification after cancelling")
+	default:
+	}
+	select {
+	case <-b:
+	default:
+		t.Error("Expected subscriber b to still be notified")
+	}
+}
@@ -0,0 +1,456 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"math"
+	"mime"
+	"slices"
+	"strconv"
+	"strings"
+
+	io_prometheus_client "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxLineLength bounds the length of a single line of the text format, so
+// that a broken controller cannot make the parser buffer without limit.
+const maxLineLength = 1 << 20
+
+// textParser reads the Prometheus text exposition format line by line and
+// only materializes the series of the families it wants. Lines of other
+// families are skipped as soon as their metric name is known, and labels
+// nobody indexes on are never copied. Precomputed summary quantiles are
+// dropped, like NewSample does.
+type textParser struct {
+	// families are the wanted families, keep the labels to materialize,
+	// every label if nil.
+	families map[string]bool
+	keep     map[model.LabelName]bool
+	// openMetrics selects the OpenMetrics flavour of the format, where
+	// counter samples end in _total and values may carry exemplars.
+	openMetrics bool
+
+	types   map[string]string
+	entries map[model.Fingerprint]*scrapedSeries
+	series  []*scrapedSeries
+
+	// hash and kept are reused from line to line, the labels of a series
+	// are only materialized the first time it is seen.
+	hash hash.Hash64
+	kept []labelPair
+}
+
+var separator = []byte{model.SeparatorByte}
+
+type labelPair struct {
+	name, value []byte
+}
+
+// decodeMetrics parses body according to its content type into the series
+// of families with the labels in keep. Anything that is neither protobuf nor
+// OpenMetrics is taken for the text format.
+func decodeMetrics(body io.Reader, contentType string, families map[string]bool, keep map[model.LabelName]bool) ([]scrapedSeries, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return parseText(body, families, keep)
+	}
+
+	switch mediaType {
+	case expfmt.ProtoType:
+		if params["proto"] != expfmt.ProtoProtocol || params["encoding"] != "delimited" {
+			return nil, fmt.Errorf("unsupported protobuf format %q", contentType)
+		}
+		return parseProtobuf(body, families, keep)
+	case expfmt.OpenMetricsType:
+		return parseOpenMetrics(body, families, keep)
+	}
+
+	return parseText(body, families, keep)
+}
+
+// parseText parses the text exposition format read from r and returns the
+// series of families with the labels in keep, every label if keep is nil.
+// Series are identified by all of their labels regardless of keep, so that
+// dropping a label never merges series.
+func parseText(r io.Reader, families map[string]bool, keep map[model.LabelName]bool) ([]scrapedSeries, error) {
+	return newTextParser(families, keep, false).parse(r)
+}
+
+// parseOpenMetrics is parseText for the OpenMetrics text format. The
+// creation timestamps of counters, histograms and summaries are dropped.
+func parseOpenMetrics(r io.Reader, families map[string]bool, keep map[model.LabelName]bool) ([]scrapedSeries, error) {
+	return newTextParser(families, keep, true).parse(r)
+}
+
+func newTextParser(families map[string]bool, keep map[model.LabelName]bool, openMetrics bool) *textParser {
+	return &textParser{
+		families:    families,
+		keep:        keep,
+		openMetrics: openMetrics,
+		types:       make(map[string]string),
+		entries:     make(map[model.Fingerprint]*scrapedSeries),
+		hash:        fnv.New64a(),
+	}
+}
+
+func (p *textParser) parse(r io.Reader) ([]scrapedSeries, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineLength)
+	for n := 1; scanner.Scan(); n++ {
+		if err := p.parseLine(scanner.Bytes()); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	series := make([]scrapedSeries, 0, len(p.series))
+	for _, s := range p.series {
+		if s.sample.Buckets != nil {
+			slices.SortFunc(s.sample.Buckets, func(a, b Bucket) int {
+				return cmp.Compare(a.UpperBound, b.UpperBound)
+			})
+			// the +Inf bucket is mandatory, but be lenient like NewSample
+			if n := len(s.sample.Buckets); n == 0 || !math.IsInf(s.sample.Buckets[n-1].UpperBound, 1) {
+				s.sample.Buckets = append(s.sample.Buckets, Bucket{UpperBound: math.Inf(1), Count: s.sample.Value})
+			}
+		}
+		series = append(series, *s)
+	}
+
+	return series, nil
+}
+
+func (p *textParser) parseLine(line []byte) error {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return nil
+	}
+	if line[0] == '#' {
+		p.parseComment(line)
+		return nil
+	}
+
+	end := bytes.IndexAny(line, "{ \t")
+	if end <= 0 {
+		return fmt.Errorf("invalid sample %q", line)
+	}
+	name := line[:end]
+
+	family, suffix, ok := p.family(name)
+	if !ok {
+		return nil
+	}
+
+	fingerprint, le, rest, err := p.parseLabels(family, line[end:])
+	if err != nil {
+		return err
+	}
+	if p.openMetrics {
+		// drop the exemplar
+		rest, _, _ = bytes.Cut(rest, []byte(" # "))
+	}
+
+	value, err := parseValue(rest)
+	if err != nil {
+		return err
+	}
+
+	s, ok := p.entries[fingerprint]
+	if !ok {
+		labels := make(model.Metric, len(p.kept)+1)
+		labels[model.MetricNameLabel] = model.LabelValue(family)
+		for _, pair := range p.kept {
+			labels[model.LabelName(pair.name)] = model.LabelValue(pair.value)
+		}
+
+		s = &scrapedSeries{labels: labels, fingerprint: fingerprint}
+		if p.types[family] == "histogram" {
+			s.sample.Buckets = []Bucket{}
+		}
+		p.entries[fingerprint] = s
+		p.series = append(p.series, s)
+	}
+
+	switch suffix {
+	case "_bucket":
+		bound, err := strconv.ParseFloat(string(le), 64)
+		if err != nil {
+			return fmt.Errorf("invalid bucket bound %q", le)
+		}
+		s.sample.Buckets = append(s.sample.Buckets, Bucket{UpperBound: bound, Count: value})
+	case "_sum":
+		s.sample.Sum = value
+	default:
+		s.sample.Value = value
+	}
+
+	return nil
+}
+
+// parseComment keeps track of the types of the wanted families, other
+// comments are ignored.
+func (p *textParser) parseComment(line []byte) {
+	rest, ok := bytes.CutPrefix(line, []byte("# TYPE "))
+	if !ok {
+		return
+	}
+
+	fields := strings.Fields(string(rest))
+	if len(fields) != 2 || !p.families[fields[0]] {
+		return
+	}
+
+	p.types[fields[0]] = fields[1]
+}
+
+// family returns the wanted family a sample named name belongs to and the
+// suffix of name within it, e.g. _bucket for the buckets of a histogram.
+// Samples of other families and precomputed summary quantiles are not
+// wanted.
+func (p *textParser) family(name []byte) (string, string, bool) {
+	if p.families[string(name)] {
+		family := string(name)
+		return family, "", p.types[family] != "summary" && p.types[family] != "histogram"
+	}
+
+	for _, suffix := range []string{"_bucket", "_sum", "_count", "_total", "_created"} {
+		base, ok := bytes.CutSuffix(name, []byte(suffix))
+		if !ok || !p.families[string(base)] {
+			continue
+		}
+
+		family := string(base)
+		if p.openMetrics {
+			switch suffix {
+			case "_created":
+				return "", "", false
+			case "_total":
+				return family, suffix, p.types[family] == "counter"
+			}
+		}
+		switch p.types[family] {
+		case "histogram":
+			return family, suffix, suffix != "_total" && suffix != "_created"
+		case "summary":
+			return family, suffix, suffix == "_sum" || suffix == "_count"
+		}
+	}
+
+	return "", "", false
+}
+
+// parseLabels parses the optional label set at the start of line into the
+// kept labels. It returns the fingerprint of the family and all of its
+// labels but le, the value of le and the rest of the line.
+func (p *textParser) parseLabels(family string, line []byte) (model.Fingerprint, []byte, []byte, error) {
+	p.kept = p.kept[:0]
+	p.hash.Reset()
+	p.hash.Write([]byte(family))
+
+	if len(line) == 0 || line[0] != '{' {
+		return model.Fingerprint(p.hash.Sum64()), nil, line, nil
+	}
+
+	var le []byte
+	line = line[1:]
+	for {
+		line = bytes.TrimLeft(line, " \t")
+		if len(line) == 0 {
+			return 0, nil, nil, fmt.Errorf("unterminated label set")
+		}
+		if line[0] == '}' {
+			return model.Fingerprint(p.hash.Sum64()), le, line[1:], nil
+		}
+
+		eq := bytes.IndexByte(line, '=')
+		if eq <= 0 {
+			return 0, nil, nil, fmt.Errorf("invalid label in %q", line)
+		}
+		name := bytes.TrimSpace(line[:eq])
+		line = bytes.TrimLeft(line[eq+1:], " \t")
+
+		value, rest, err := parseLabelValue(line)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		line = bytes.TrimLeft(rest, " \t")
+		if len(line) > 0 && line[0] == ',' {
+			line = line[1:]
+		}
+
+		if string(name) == "le" {
+			le = value
+			continue
+		}
+
+		p.hash.Write(separator)
+		p.hash.Write(name)
+		p.hash.Write(separator)
+		p.hash.Write(value)
+		if p.keep == nil || p.keep[model.LabelName(name)] {
+			p.kept = append(p.kept, labelPair{name: name, value: value})
+		}
+	}
+}
+
+// parseLabelValue parses the quoted label value at the start of line and
+// returns it unescaped along with the rest of the line. The value points
+// into line unless it had to be unescaped.
+func parseLabelValue(line []byte) ([]byte, []byte, error) {
+	if len(line) == 0 || line[0] != '"' {
+		return nil, nil, fmt.Errorf("label value %q is not quoted", line)
+	}
+
+	var value []byte
+	for i := 1; i < len(line); i++ {
+		switch line[i] {
+		case '"':
+			if value == nil {
+				return line[1:i], line[i+1:], nil
+			}
+			return value, line[i+1:], nil
+		case '\\':
+			if value == nil {
+				value = append([]byte{}, line[1:i]...)
+			}
+			i++
+			if i == len(line) {
+				return nil, nil, fmt.Errorf("unterminated label value")
+			}
+			switch line[i] {
+			case 'n':
+				value = append(value, '\n')
+			case '\\', '"':
+				value = append(value, line[i])
+			default:
+				return nil, nil, fmt.Errorf("invalid escape sequence \\%c", line[i])
+			}
+		default:
+			if value != nil {
+				value = append(value, line[i])
+			}
+		}
+	}
+
+	return nil, nil, fmt.Errorf("unterminated label value")
+}
+
+// parseValue parses the value of a sample, the optional timestamp after it
+// is ignored.
+func parseValue(line []byte) (float64, error) {
+	field, timestamp := bytes.TrimSpace(line), []byte(nil)
+	if i := bytes.IndexAny(field, " \t"); i >= 0 {
+		field, timestamp = field[:i], bytes.TrimSpace(field[i:])
+	}
+	if len(field) == 0 || bytes.ContainsAny(timestamp, " \t") {
+		return 0, fmt.Errorf("invalid value %q", line)
+	}
+
+	// ParseFloat also understands +Inf, -Inf and NaN
+	value, err := strconv.ParseFloat(string(field), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", field)
+	}
+
+	return value, nil
+}
+
+// maxMessageSize bounds the size of a single metric family in the
+// delimited protobuf format, for the same reason as maxLineLength.
+const maxMessageSize = 64 << 20
+
+// parseProtobuf is parseText for the delimited protobuf format. Metric
+// families that are not wanted are skipped without being unmarshalled.
+func parseProtobuf(r io.Reader, families map[string]bool, keep map[model.LabelName]bool) ([]scrapedSeries, error) {
+	br := bufio.NewReader(r)
+	h := fnv.New64a()
+
+	var series []scrapedSeries
+	var buf []byte
+	for {
+		size, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return series, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if size > maxMessageSize {
+			return nil, fmt.Errorf("metric family of %d bytes exceeds the limit of %d", size, maxMessageSize)
+		}
+
+		buf = slices.Grow(buf[:0], int(size))[:size]
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, err
+		}
+		if name, ok := familyName(buf); ok && !families[name] {
+			continue
+		}
+
+		var mf io_prometheus_client.MetricFamily
+		if err := proto.Unmarshal(buf, &mf); err != nil {
+			return nil, err
+		}
+		if !families[mf.GetName()] {
+			continue
+		}
+
+		for _, m := range mf.GetMetric() {
+			labels := model.Metric{model.MetricNameLabel: model.LabelValue(mf.GetName())}
+			h.Reset()
+			h.Write([]byte(mf.GetName()))
+			for _, lp := range m.GetLabel() {
+				h.Write(separator)
+				h.Write([]byte(lp.GetName()))
+				h.Write(separator)
+				h.Write([]byte(lp.GetValue()))
+				if keep == nil || keep[model.LabelName(lp.GetName())] {
+					labels[model.LabelName(lp.GetName())] = model.LabelValue(lp.GetValue())
+				}
+			}
+
+			series = append(series, scrapedSeries{
+				labels:      labels,
+				fingerprint: model.Fingerprint(h.Sum64()),
+				sample:      NewSample(&mf, m),
+			})
+		}
+	}
+}
+
+// familyName returns the name of the encoded metric family msg, without
+// unmarshalling the rest of it.
+func familyName(msg []byte) (string, bool) {
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return "", false
+		}
+		msg = msg[n:]
+
+		if num == 1 && typ == protowire.BytesType {
+			name, n := protowire.ConsumeBytes(msg)
+			return string(name), n >= 0
+		}
+
+		n = protowire.ConsumeFieldValue(num, typ, msg)
+		if n < 0 {
+			return "", false
+		}
+		msg = msg[n:]
+	}
+
+	return "", false
+}
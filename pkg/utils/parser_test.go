@@ -0,0 +1,337 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	requestsFamily = "nginx_ingress_controller_requests"
+	durationFamily = "nginx_ingress_controller_request_duration_seconds"
+)
+
+// ingressNginxPayload renders what an ingress-nginx controller exposes for
+// the given number of ingresses: the histograms it keeps per ingress,
+// status and method, its connection gauges and the usual Go runtime
+// metrics.
+func ingressNginxPayload(ingresses int) []byte {
+	var b bytes.Buffer
+	histograms := []string{
+		durationFamily,
+		"nginx_ingress_controller_response_duration_seconds",
+		"nginx_ingress_controller_request_size",
+		"nginx_ingress_controller_response_size",
+		"nginx_ingress_controller_bytes_sent",
+	}
+	bounds := []string{"0.005", "0.01", "0.025", "0.05", "0.1", "0.25", "0.5", "1", "2.5", "5", "10", "+Inf"}
+
+	fmt.Fprintln(&b, "# HELP go_gc_duration_seconds A summary of the pause duration of garbage collection cycles.")
+	fmt.Fprintln(&b, "# TYPE go_gc_duration_seconds summary")
+	for _, q := range []string{"0", "0.25", "0.5", "0.75", "1"} {
+		fmt.Fprintf(&b, "go_gc_duration_seconds{quantile=%q} 0.0001\n", q)
+	}
+	fmt.Fprintln(&b, "go_gc_duration_seconds_sum 0.5")
+	fmt.Fprintln(&b, "go_gc_duration_seconds_count 1000")
+	fmt.Fprintln(&b, "# HELP go_goroutines Number of goroutines that currently exist.")
+	fmt.Fprintln(&b, "# TYPE go_goroutines gauge")
+	fmt.Fprintln(&b, "go_goroutines 120")
+
+	fmt.Fprintln(&b, "# HELP nginx_ingress_controller_nginx_process_connections current number of client connections with state {active, reading, writing, waiting}")
+	fmt.Fprintln(&b, "# TYPE nginx_ingress_controller_nginx_process_connections gauge")
+	for _, state := range []string{"active", "reading", "writing", "waiting"} {
+		fmt.Fprintf(&b, "nginx_ingress_controller_nginx_process_connections{controller_class=\"k8s.io/ingress-nginx\",controller_namespace=\"ingress-nginx\",controller_pod=\"ingress-nginx-controller-7d9f8b6c5-x2x4z\",state=%q} 17\n", state)
+	}
+
+	series := func(i int, status, method string) string {
+		return fmt.Sprintf(`canary="",controller_class="k8s.io/ingress-nginx",controller_namespace="ingress-nginx",controller_pod="ingress-nginx-controller-7d9f8b6c5-x2x4z",host="app-%d.example.com",ingress="app-%d",method=%q,namespace="team-%d",path="/",service="app-%d",status=%q`, i, i, method, i%10, i, status)
+	}
+	for _, family := range histograms {
+		fmt.Fprintf(&b, "# HELP %s The histogram of %s\n", family, family)
+		fmt.Fprintf(&b, "# TYPE %s histogram\n", family)
+		for i := range ingresses {
+			for _, status := range []string{"200", "201", "304", "404", "500"} {
+				for _, method := range []string{"GET", "POST"} {
+					labels := series(i, status, method)
+					for j, bound := range bounds {
+						fmt.Fprintf(&b, "%s_bucket{%s,le=%q} %d\n", family, labels, bound, 10*(j+1))
+					}
+					fmt.Fprintf(&b, "%s_sum{%s} 42.5\n", family, labels)
+					fmt.Fprintf(&b, "%s_count{%s} %d\n", family, labels, 10*len(bounds))
+				}
+			}
+		}
+	}
+
+	fmt.Fprintf(&b, "# HELP %s The total number of client requests\n", requestsFamily)
+	fmt.Fprintf(&b, "# TYPE %s counter\n", requestsFamily)
+	for i := range ingresses {
+		for _, status := range []string{"200", "201", "304", "404", "500"} {
+			for _, method := range []string{"GET", "POST"} {
+				fmt.Fprintf(&b, "%s{%s} %d\n", requestsFamily, series(i, status, method), 1000+i)
+			}
+		}
+	}
+
+	return b.Bytes()
+}
+
+// parseWithExpfmt is how metrics were parsed before parseText, it serves as
+// the reference.
+func parseWithExpfmt(t testing.TB, payload []byte, families map[string]bool) map[string]Sample {
+	var parser expfmt.TextParser
+	metricFamilies, err := parser.TextToMetricFamilies(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	samples := make(map[string]Sample)
+	for name, mf := range metricFamilies {
+		if !families[name] {
+			continue
+		}
+
+		for _, m := range mf.Metric {
+			labels := model.Metric{model.MetricNameLabel: model.LabelValue(name)}
+			for _, lp := range m.Label {
+				labels[model.LabelName(lp.GetName())] = model.LabelValue(lp.GetValue())
+			}
+			samples[labels.String()] = NewSample(mf, m)
+		}
+	}
+
+	return samples
+}
+
+func TestParseText(t *testing.T) {
+	payload := ingressNginxPayload(3)
+	families := map[string]bool{
+		requestsFamily:           true,
+		durationFamily:           true,
+		"go_gc_duration_seconds": true,
+		"go_goroutines":          true,
+		"nginx_ingress_controller_nginx_process_connections": true,
+	}
+
+	series, err := parseText(bytes.NewReader(payload), families, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	samples := make(map[string]Sample, len(series))
+	for _, s := range series {
+		samples[s.labels.String()] = s.sample
+	}
+	if expected := parseWithExpfmt(t, payload, families); !reflect.DeepEqual(samples, expected) {
+		t.Errorf("Expected the samples of the expfmt parser, got %d samples instead of %d", len(samples), len(expected))
+		for key, sample := range expected {
+			if !reflect.DeepEqual(samples[key], sample) {
+				t.Errorf("Expected %s to be %v, got %v", key, sample, samples[key])
+				break
+			}
+		}
+	}
+}
+
+func TestParseTextFilters(t *testing.T) {
+	payload := strings.Join([]string{
+		`# TYPE requests counter`,
+		`requests{ingress="web",status="200",pod="a"} 10`,
+		`requests{ingress="web",status="200",pod="b"} 20 1700000000000`,
+		`requests{ingress="w\"e\\b\n",status="500"} 5`,
+		`# TYPE other counter`,
+		`other{ingress="web"} 1`,
+		`untyped 3`,
+	}, "\n")
+
+	series, err := parseText(strings.NewReader(payload), map[string]bool{"requests": true, "untyped": true}, map[model.LabelName]bool{"ingress": true})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(series) != 4 {
+		t.Fatalf("Expected 4 series, got %v", series)
+	}
+
+	if series[0].fingerprint == series[1].fingerprint {
+		t.Error("Expected series that only differ in dropped labels to be told apart")
+	}
+	expected := model.Metric{model.MetricNameLabel: "requests", "ingress": "web"}
+	if !reflect.DeepEqual(series[1].labels, expected) || series[1].sample.Value != 20 {
+		t.Errorf("Expected %v 20, got %v %v", expected, series[1].labels, series[1].sample.Value)
+	}
+	if ingress := series[2].labels["ingress"]; ingress != "w\"e\\b\n" {
+		t.Errorf("Expected escaped label values to be unescaped, got %q", ingress)
+	}
+	if series[3].labels[model.MetricNameLabel] != "untyped" || series[3].sample.Value != 3 {
+		t.Errorf("Expected the untyped sample, got %v", series[3])
+	}
+
+	for _, invalid := range []string{
+		`requests{ingress="web"`,
+		`requests{ingress=web} 1`,
+		`requests{ingress="web} 1`,
+		`requests{ingress="w\eb"} 1`,
+		`requests{ingress="web"}`,
+		`requests{ingress="web"} one`,
+		`requests{ingress="web"} 1 2 3`,
+	} {
+		if _, err := parseText(strings.NewReader(invalid), map[string]bool{"requests": true}, nil); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+// encodePayload re-encodes the text format payload in format.
+func encodePayload(t testing.TB, payload []byte, format expfmt.Format) []byte {
+	var parser expfmt.TextParser
+	metricFamilies, err := parser.TextToMetricFamilies(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var b bytes.Buffer
+	encoder := expfmt.NewEncoder(&b, format)
+	for _, name := range slices.Sorted(maps.Keys(metricFamilies)) {
+		if err := encoder.Encode(metricFamilies[name]); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	if closer, ok := encoder.(expfmt.Closer); ok {
+		if err := closer.Close(); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	return b.Bytes()
+}
+
+func TestDecodeMetrics(t *testing.T) {
+	payload := ingressNginxPayload(3)
+	families := map[string]bool{
+		requestsFamily:           true,
+		durationFamily:           true,
+		"go_gc_duration_seconds": true,
+		"nginx_ingress_controller_nginx_process_connections": true,
+	}
+	expected := parseWithExpfmt(t, payload, families)
+
+	for _, format := range []expfmt.Format{
+		expfmt.NewFormat(expfmt.TypeTextPlain),
+		expfmt.NewFormat(expfmt.TypeProtoDelim),
+		expfmt.NewFormat(expfmt.TypeOpenMetrics),
+	} {
+		series, err := decodeMetrics(bytes.NewReader(encodePayload(t, payload, format)), string(format), families, nil)
+		if err != nil {
+			t.Errorf("Expected no error for %s, got %v", format, err)
+			continue
+		}
+
+		samples := make(map[string]Sample, len(series))
+		for _, s := range series {
+			samples[s.labels.String()] = s.sample
+		}
+		if !reflect.DeepEqual(samples, expected) {
+			t.Errorf("Expected the samples of the expfmt parser for %s, got %d samples instead of %d", format, len(samples), len(expected))
+		}
+	}
+
+	if _, err := decodeMetrics(strings.NewReader(""), "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=text", families, nil); err == nil {
+		t.Error("Expected an error for the protobuf text format")
+	}
+}
+
+func TestParseOpenMetrics(t *testing.T) {
+	payload := strings.Join([]string{
+		`# TYPE requests counter`,
+		`# HELP requests The total number of client requests.`,
+		`requests_total{ingress="web"} 10 # {trace_id="abc"} 1 1700000000.123`,
+		`requests_created{ingress="web"} 1700000000`,
+		`# TYPE latency histogram`,
+		`latency_bucket{ingress="web",le="0.1"} 1`,
+		`latency_bucket{ingress="web",le="+Inf"} 2 # {trace_id="def"} 0.5`,
+		`latency_sum{ingress="web"} 0.6`,
+		`latency_count{ingress="web"} 2`,
+		`latency_created{ingress="web"} 1700000000`,
+		`# EOF`,
+	}, "\n")
+
+	series, err := parseOpenMetrics(strings.NewReader(payload), map[string]bool{"requests": true, "latency": true}, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expected := []Sample{
+		{Value: 10},
+		{Value: 2, Sum: 0.6, Buckets: []Bucket{{UpperBound: 0.1, Count: 1}, {UpperBound: math.Inf(1), Count: 2}}},
+	}
+	if len(series) != len(expected) {
+		t.Fatalf("Expected %d series, got %v", len(expected), series)
+	}
+	for i, s := range series {
+		if !reflect.DeepEqual(s.sample, expected[i]) {
+			t.Errorf("Expected %v to be %v, got %v", s.labels, expected[i], s.sample)
+		}
+	}
+}
+
+func BenchmarkParseText(b *testing.B) {
+	payload := ingressNginxPayload(200)
+	families := map[string]bool{requestsFamily: true}
+	keep := map[model.LabelName]bool{"namespace": true, "ingress": true, "status": true}
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+
+	for b.Loop() {
+		if _, err := parseText(bytes.NewReader(payload), families, keep); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseTextHistogram(b *testing.B) {
+	payload := ingressNginxPayload(200)
+	families := map[string]bool{durationFamily: true}
+	keep := map[model.LabelName]bool{"namespace": true, "ingress": true, "status": true}
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+
+	for b.Loop() {
+		if _, err := parseText(bytes.NewReader(payload), families, keep); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseProtobuf(b *testing.B) {
+	payload := encodePayload(b, ingressNginxPayload(200), expfmt.NewFormat(expfmt.TypeProtoDelim))
+	families := map[string]bool{requestsFamily: true}
+	keep := map[model.LabelName]bool{"namespace": true, "ingress": true, "status": true}
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+
+	for b.Loop() {
+		if _, err := parseProtobuf(bytes.NewReader(payload), families, keep); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkTextToMetricFamilies is the baseline parseText improves on.
+func BenchmarkTextToMetricFamilies(b *testing.B) {
+	payload := ingressNginxPayload(200)
+	families := map[string]bool{requestsFamily: true}
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+
+	for b.Loop() {
+		parseWithExpfmt(b, payload, families)
+	}
+}
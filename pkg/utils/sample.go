@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"math"
+	"sort"
+
+	io_prometheus_client "github.com/prometheus/client_model/go"
+)
+
+// Bucket is a cumulative histogram bucket.
+type Bucket struct {
+	UpperBound float64
+	Count      float64
+}
+
+// Sample is the value of a single series. Counters, gauges and untyped
+// metrics only set Value; histograms and summaries set Value to the sample
+// count and also carry the sample sum, histograms also their cumulative
+// buckets, ending with +Inf.
+type Sample struct {
+	Value   float64
+	Sum     float64
+	Buckets []Bucket
+}
+
+func NewSample(mf *io_prometheus_client.MetricFamily, m *io_prometheus_client.Metric) Sample {
+	switch mf.GetType() {
+	case io_prometheus_client.MetricType_COUNTER:
+		return Sample{Value: m.GetCounter().GetValue()}
+	case io_prometheus_client.MetricType_GAUGE:
+		return Sample{Value: m.GetGauge().GetValue()}
+	case io_prometheus_client.MetricType_UNTYPED:
+		return Sample{Value: m.GetUntyped().GetValue()}
+	case io_prometheus_client.MetricType_SUMMARY:
+		// precomputed quantiles cannot be aggregated, only keep the
+		// counters
+		return Sample{Value: float64(m.GetSummary().GetSampleCount()), Sum: m.GetSummary().GetSampleSum()}
+	case io_prometheus_client.MetricType_HISTOGRAM:
+		h := m.GetHistogram()
+		sample := Sample{
+			Value:   float64(h.GetSampleCount()),
+			Sum:     h.GetSampleSum(),
+			Buckets: make([]Bucket, 0, len(h.GetBucket())+1),
+		}
+		for _, b := range h.GetBucket() {
+			sample.Buckets = append(sample.Buckets, Bucket{
+				UpperBound: b.GetUpperBound(),
+				Count:      float64(b.GetCumulativeCount()),
+			})
+		}
+
+		// The protobuf format leaves out the implicit +Inf bucket.
+		if n := len(sample.Buckets); n == 0 || !math.IsInf(sample.Buckets[n-1].UpperBound, 1) {
+			sample.Buckets = append(sample.Buckets, Bucket{UpperBound: math.Inf(1), Count: sample.Value})
+		}
+
+		return sample
+	}
+
+	return Sample{}
+}
+
+// Add returns the sum of s and o, merging buckets by upper bound.
+func (s Sample) Add(o Sample) Sample {
+	result := Sample{
+		Value: s.Value + o.Value,
+		Sum:   s.Sum + o.Sum,
+	}
+	if len(s.Buckets) == 0 && len(o.Buckets) == 0 {
+		return result
+	}
+
+	counts := make(map[float64]float64, len(s.Buckets))
+	for _, b := range s.Buckets {
+		counts[b.UpperBound] += b.Count
+	}
+	for _, b := range o.Buckets {
+		counts[b.UpperBound] += b.Count
+	}
+
+	result.Buckets = make([]Bucket, 0, len(counts))
+	for upperBound, count := range counts {
+		result.Buckets = append(result.Buckets, Bucket{UpperBound: upperBound, Count: count})
+	}
+	sort.Slice(result.Buckets, func(i, j int) bool {
+		return result.Buckets[i].UpperBound < result.Buckets[j].UpperBound
+	})
+
+	return result
+}
+
+// Sub returns s minus o, matching buckets by upper bound.
+func (s Sample) Sub(o Sample) Sample {
+	return s.Add(o.Scale(-1))
+}
+
+// Scale multiplies every part of s by factor.
+func (s Sample) Scale(factor float64) Sample {
+	result := Sample{
+		Value: s.Value * factor,
+		Sum:   s.Sum * factor,
+	}
+	if len(s.Buckets) > 0 {
+		result.Buckets = make([]Bucket, len(s.Buckets))
+		for i, b := range s.Buckets {
+			result.Buckets[i] = Bucket{UpperBound: b.UpperBound, Count: b.Count * factor}
+		}
+	}
+
+	return result
+}
+
+// Quantile estimates the q-quantile of the observations counted in the
+// buckets of s the same way PromQL histogram_quantile() does, by linear
+// interpolation inside the bucket the quantile falls into. It returns NaN
+// if s holds no observations.
+func (s Sample) Quantile(q float64) float64 {
+	if q < 0 {
+		return math.Inf(-1)
+	}
+	if q > 1 {
+		return math.Inf(1)
+	}
+
+	buckets := s.Buckets
+	if len(buckets) < 2 || !math.IsInf(buckets[len(buckets)-1].UpperBound, 1) {
+		return math.NaN()
+	}
+
+	observations := buckets[len(buckets)-1].Count
+	if observations <= 0 {
+		return math.NaN()
+	}
+
+	rank := q * observations
+	b := sort.Search(len(buckets)-1, func(i int) bool { return buckets[i].Count >= rank })
+	if b == len(buckets)-1 {
+		return buckets[len(buckets)-2].UpperBound
+	}
+	if b == 0 && buckets[0].UpperBound <= 0 {
+		return buckets[0].UpperBound
+	}
+
+	var bucketStart float64
+	bucketEnd := buckets[b].UpperBound
+	count := buckets[b].Count
+	if b > 0 {
+		bucketStart = buckets[b-1].UpperBound
+		count -= buckets[b-1].Count
+		rank -= buckets[b-1].Count
+	}
+
+	return bucketStart + (bucketEnd-bucketStart)*(rank/count)
+}
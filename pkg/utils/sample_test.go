@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"math"
+	"testing"
+)
+
+func histogram(sum float64, counts ...float64) Sample {
+	upperBounds := []float64{0.1, 0.25, 0.5, 1, math.Inf(1)}
+	sample := Sample{Value: counts[len(counts)-1], Sum: sum}
+	for i, count := range counts {
+		sample.Buckets = append(sample.Buckets, Bucket{UpperBound: upperBounds[i], Count: count})
+	}
+
+	return sample
+}
+
+func TestSampleAddSub(t *testing.T) {
+	a := histogram(10, 1, 2, 3, 4, 5)
+	b := histogram(5, 0, 1, 1, 1, 2)
+
+	sum := a.Add(b)
+	if sum.Value != 7 || sum.Sum != 15 {
+		t.Errorf("Expected value 7 and sum 15, got %f and %f", sum.Value, sum.Sum)
+	}
+	if sum.Buckets[1].Count != 3 || sum.Buckets[4].Count != 7 {
+		t.Errorf("Expected buckets to be merged, got %v", sum.Buckets)
+	}
+
+	diff := a.Sub(b)
+	if diff.Value != 3 || diff.Sum != 5 {
+		t.Errorf("Expected value 3 and sum 5, got %f and %f", diff.Value, diff.Sum)
+	}
+	if diff.Buckets[0].Count != 1 || diff.Buckets[3].Count != 3 {
+		t.Errorf("Expected buckets to be subtracted, got %v", diff.Buckets)
+	}
+
+	counter := Sample{Value: 3}.Add(Sample{Value: 4})
+	if counter.Value != 7 || counter.Buckets != nil {
+		t.Errorf("Expected plain counter sum 7, got %v", counter)
+	}
+}
+
+func TestSampleQuantile(t *testing.T) {
+	sample := histogram(0, 0, 50, 90, 100, 100)
+
+	if q := sample.Quantile(0.5); q != 0.25 {
+		t.Errorf("Expected p50 to be 0.25, got %f", q)
+	}
+	if q := sample.Quantile(0.7); math.Abs(q-0.375) > 1e-9 {
+		t.Errorf("Expected p70 to be 0.375, got %f", q)
+	}
+	if q := sample.Quantile(0.25); math.Abs(q-0.175) > 1e-9 {
+		t.Errorf("Expected p25 to be 0.175, got %f", q)
+	}
+
+	// observations above the highest finite bucket are reported as its
+	// upper bound
+	sample = histogram(0, 0, 0, 0, 10, 100)
+	if q := sample.Quantile(0.99); q != 1 {
+		t.Errorf("Expected p99 to be 1, got %f", q)
+	}
+
+	if q := histogram(0, 0, 0, 0, 0, 0).Quantile(0.5); !math.IsNaN(q) {
+		t.Errorf("Expected NaN without observations, got %f", q)
+	}
+}
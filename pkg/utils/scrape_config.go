@@ -0,0 +1,174 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// TLSConfig configures how the metrics endpoints of controllers are
+// verified, and the client certificate presented to them if any.
+type TLSConfig struct {
+	CAFile             string `json:"caFile,omitempty"`
+	CertFile           string `json:"certFile,omitempty"`
+	KeyFile            string `json:"keyFile,omitempty"`
+	ServerName         string `json:"serverName,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+}
+
+// ScrapeConfig configures how the controllers of the ingress classes
+// matching the glob IngressClass are scraped, e.g. over HTTPS behind
+// kube-rbac-proxy. Zero values keep the defaults: plain HTTP on the healthz
+// port at /metrics, without authentication.
+type ScrapeConfig struct {
+	IngressClass    string            `json:"ingressClass"`
+	Scheme          string            `json:"scheme,omitempty"`
+	Port            int               `json:"port,omitempty"`
+	Path            string            `json:"path,omitempty"`
+	TLS             TLSConfig         `json:"tls,omitempty"`
+	BearerTokenFile string            `json:"bearerTokenFile,omitempty"`
+	Headers         map[string]string `json:"headers,omitempty"`
+
+	client *http.Client
+}
+
+// ScrapeConfigs is the content of the scrape configuration file.
+type ScrapeConfigs struct {
+	IngressClasses []*ScrapeConfig `json:"ingressClasses"`
+}
+
+// LoadScrapeConfigs reads the scrape configuration file at path, in YAML or
+// JSON.
+func LoadScrapeConfigs(path string) (*ScrapeConfigs, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs ScrapeConfigs
+	if err := yaml.UnmarshalStrict(data, &configs); err != nil {
+		return nil, fmt.Errorf("invalid scrape config %s: %v", path, err)
+	}
+
+	for _, config := range configs.IngressClasses {
+		if err := config.init(); err != nil {
+			return nil, fmt.Errorf("invalid scrape config for ingress class %q: %v", config.IngressClass, err)
+		}
+	}
+
+	return &configs, nil
+}
+
+// Match returns the first config whose glob matches ingressClass, or nil if
+// there is none.
+func (c *ScrapeConfigs) Match(ingressClass string) *ScrapeConfig {
+	if c == nil {
+		return nil
+	}
+
+	for _, config := range c.IngressClasses {
+		if match, err := filepath.Match(config.IngressClass, ingressClass); match && err == nil {
+			return config
+		}
+	}
+
+	return nil
+}
+
+// init validates the config and builds its HTTP client.
+func (c *ScrapeConfig) init() error {
+	if _, err := filepath.Match(c.IngressClass, ""); err != nil {
+		return fmt.Errorf("invalid ingressClass glob: %v", err)
+	}
+	switch c.Scheme {
+	case "", "http", "https":
+	default:
+		return fmt.Errorf("unsupported scheme %s", c.Scheme)
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid port %d", c.Port)
+	}
+	if c.Path != "" && !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("path %s is not absolute", c.Path)
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return fmt.Errorf("certFile and keyFile must be set together")
+	}
+	if c.BearerTokenFile != "" {
+		if _, err := os.ReadFile(c.BearerTokenFile); err != nil {
+			return err
+		}
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         c.TLS.ServerName,
+		InsecureSkipVerify: c.TLS.InsecureSkipVerify,
+	}
+	if c.TLS.CAFile != "" {
+		ca, err := os.ReadFile(c.TLS.CAFile)
+		if err != nil {
+			return err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("no certificates found in %s", c.TLS.CAFile)
+		}
+	}
+	if c.TLS.CertFile != "" {
+		if _, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile); err != nil {
+			return err
+		}
+
+		// load the certificate on every handshake so that rotated
+		// certificates are picked up
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+			return &cert, err
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	c.client = &http.Client{Transport: transport}
+
+	return nil
+}
+
+// httpClient returns the HTTP client to scrape with, the default client for
+// a nil config.
+func (c *ScrapeConfig) httpClient() *http.Client {
+	if c == nil || c.client == nil {
+		return http.DefaultClient
+	}
+
+	return c.client
+}
+
+// authorize adds the configured headers and the bearer token to req. The
+// token file is read on every scrape, so that rotated service account
+// tokens are picked up.
+func (c *ScrapeConfig) authorize(req *http.Request) error {
+	if c == nil {
+		return nil
+	}
+
+	for name, value := range c.Headers {
+		req.Header.Set(name, value)
+	}
+	if c.BearerTokenFile != "" {
+		token, err := os.ReadFile(c.BearerTokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	return nil
+}
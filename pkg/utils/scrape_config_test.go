@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeClientCert writes a self-signed client certificate and its key to
+// dir and returns the certificate.
+func writeClientCert(t *testing.T, dir string) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "scaler"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, filepath.Join(dir, "client.crt"), string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	writeFile(t, filepath.Join(dir, "client.key"), string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScrapeConfigTLS(t *testing.T) {
+	dir := t.TempDir()
+	clientCert := writeClientCert(t, dir)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer rotated" || r.Header.Get("X-Scope") != "metrics" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintln(w, `test{ingress="web"} 42`)
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	writeFile(t, filepath.Join(dir, "ca.crt"), string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})))
+	writeFile(t, filepath.Join(dir, "token"), "initial\n")
+	writeFile(t, filepath.Join(dir, "config.yaml"), fmt.Sprintf(`
+ingressClasses:
+- ingressClass: internal-*
+  scheme: https
+  port: 8443
+  tls:
+    caFile: %[1]s/ca.crt
+    certFile: %[1]s/client.crt
+    keyFile: %[1]s/client.key
+  bearerTokenFile: %[1]s/token
+  headers:
+    X-Scope: metrics
+`, dir))
+
+	configs, err := LoadScrapeConfigs(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	config := configs.Match("internal-nginx")
+	if config == nil || configs.Match("nginx") != nil {
+		t.Fatalf("Expected only internal classes to match, got %v", configs.IngressClasses)
+	}
+
+	families := map[string]bool{"test": true}
+	if _, err := fetchMetrics(context.Background(), server.URL, config, families, nil); err == nil {
+		t.Error("Expected the initial token to be rejected")
+	}
+
+	// the token is read on every scrape
+	writeFile(t, filepath.Join(dir, "token"), "rotated\n")
+	series, err := fetchMetrics(context.Background(), server.URL, config, families, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(series) != 1 || series[0].sample.Value != 42 {
+		t.Errorf("Expected the sample of the controller, got %v", series)
+	}
+
+	if _, err := fetchMetrics(context.Background(), server.URL, nil, families, nil); err == nil {
+		t.Error("Expected the certificate of the controller not to be trusted by default")
+	}
+}
+
+func TestLoadScrapeConfigsErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	for i, config := range []string{
+		"ingressClasses:\n- ingressClass: nginx\n  scheme: ftp\n",
+		"ingressClasses:\n- ingressClass: nginx\n  port: 70000\n",
+		"ingressClasses:\n- ingressClass: nginx\n  path: metrics\n",
+		"ingressClasses:\n- ingressClass: '[nginx'\n",
+		"ingressClasses:\n- ingressClass: nginx\n  tls:\n    certFile: client.crt\n",
+		"ingressClasses:\n- ingressClass: nginx\n  tls:\n    caFile: missing.crt\n",
+		"ingressClasses:\n- ingressClass: nginx\n  bearerTokenFile: missing\n",
+		"ingressClasses:\n- ingressClass: nginx\n  bearerToken: secret\n",
+	} {
+		path := filepath.Join(dir, fmt.Sprintf("config-%d.yaml", i))
+		writeFile(t, path, config)
+		if _, err := LoadScrapeConfigs(path); err == nil {
+			t.Errorf("Expected an error for %q", config)
+		}
+	}
+}
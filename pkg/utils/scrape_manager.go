@@ -0,0 +1,297 @@
+package utils
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"k8s.io/klog/v2"
+)
+
+// DefaultScrapeConcurrency is the number of controllers scraped at once if
+// ScrapeOptions does not say otherwise.
+const DefaultScrapeConcurrency = 16
+
+// ScrapeOptions configure how controllers are scraped. Zero values select
+// the defaults: requests time out after one scrape interval and up to
+// DefaultScrapeConcurrency controllers are scraped at once.
+type ScrapeOptions struct {
+	Timeout     time.Duration
+	Concurrency int
+}
+
+// acceptHeader asks for the delimited protobuf format first, then for
+// OpenMetrics and the text format, with the same preferences Prometheus has.
+const acceptHeader = `application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,` +
+	`application/openmetrics-text;version=1.0.0;q=0.5,application/openmetrics-text;version=0.0.1;q=0.4,` +
+	`text/plain;version=0.0.4;q=0.3,*/*;q=0.1`
+
+// scrapedSeries is a single series of a scrape, its labels include the
+// family name.
+type scrapedSeries struct {
+	labels      model.Metric
+	fingerprint model.Fingerprint
+	sample      Sample
+}
+
+// ScrapeManager scrapes every controller once per interval, however many
+// caches are interested in it, and hands the samples to all of them. The
+// caches only pay for indexing the series of the families they keep.
+type ScrapeManager struct {
+	interval time.Duration
+	options  ScrapeOptions
+	// failures counts the consecutive failed scrapes by controller.
+	failures map[string]int
+	// labels are the labels the consumers index on, nil for all of them.
+	labels map[model.LabelName]bool
+	// configFunc returns how to scrape a controller, nil for the defaults.
+	configFunc func(addr string) *ScrapeConfig
+
+	consumers []*CounterCache
+	mu        sync.RWMutex
+}
+
+func NewScrapeManager(interval time.Duration) *ScrapeManager {
+	return &ScrapeManager{
+		interval: interval,
+		failures: make(map[string]int),
+	}
+}
+
+// SetScrapeOptions sets how the controllers are scraped.
+func (m *ScrapeManager) SetScrapeOptions(options ScrapeOptions) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.options = options
+}
+
+// KeepLabels makes the manager drop every label of the scraped series but
+// names and the metric name, which saves copying labels such as the
+// controller pod nobody indexes on. Series that only differ in dropped
+// labels are still told apart.
+func (m *ScrapeManager) KeepLabels(names ...model.LabelName) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.labels = make(map[model.LabelName]bool, len(names))
+	for _, name := range names {
+		m.labels[name] = true
+	}
+}
+
+// SetConfigFunc sets the function that decides how the controller at an
+// address is scraped.
+func (m *ScrapeManager) SetConfigFunc(f func(addr string) *ScrapeConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.configFunc = f
+}
+
+// Register makes the manager feed cache from the next scrape on.
+func (m *ScrapeManager) Register(cache *CounterCache) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.consumers = append(m.consumers, cache)
+}
+
+func (m *ScrapeManager) Run(stopCh <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	klog.V(4).Infof("Starting scrape manager with interval %s", m.interval)
+	for {
+		select {
+		case now := <-ticker.C:
+			m.ScrapeOnce(ctx, now)
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// ScrapeOnce scrapes the union of the controllers of all caches for the
+// union of their families, and passes the result taken at now on to every
+// cache.
+func (m *ScrapeManager) ScrapeOnce(ctx context.Context, now time.Time) {
+	m.mu.RLock()
+	consumers := m.consumers
+	m.mu.RUnlock()
+
+	targets := make(map[*CounterCache][]string, len(consumers))
+	addrs := make(map[string]bool)
+	families := make(map[string]bool)
+	for _, cache := range consumers {
+		targets[cache] = cache.targets()
+		for _, addr := range targets[cache] {
+			addrs[addr] = true
+		}
+		for _, name := range cache.familyNames() {
+			families[name] = true
+		}
+	}
+
+	scraped, failing := m.scrape(ctx, addrs, families)
+	m.mu.Lock()
+	// forget the failures of controllers that are gone
+	maps.DeleteFunc(m.failures, func(addr string, _ int) bool { return !addrs[addr] })
+	m.mu.Unlock()
+
+	for _, cache := range consumers {
+		cache.collect(now, targets[cache], scraped, failing)
+	}
+}
+
+// scrape fetches the families of all addrs with a bounded number of
+// requests in flight, and returns the series of the controllers that
+// answered along with the ones that did not. Requests still running after
+// one scrape interval are cancelled, so that a hung controller cannot hold
+// up the next scrape.
+func (m *ScrapeManager) scrape(ctx context.Context, addrs map[string]bool, families map[string]bool) (map[string][]scrapedSeries, map[string]bool) {
+	ctx, cancel := context.WithTimeout(ctx, m.interval)
+	defer cancel()
+
+	m.mu.RLock()
+	options, labels, configFunc := m.options, m.labels, m.configFunc
+	m.mu.RUnlock()
+	timeout := options.Timeout
+	if timeout <= 0 || timeout > m.interval {
+		timeout = m.interval
+	}
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultScrapeConcurrency
+	}
+
+	type result struct {
+		addr   string
+		series []scrapedSeries
+		err    error
+	}
+	results := make(chan result, len(addrs))
+	slots := make(chan struct{}, concurrency)
+	for addr := range addrs {
+		go func() {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				results <- result{addr: addr, err: ctx.Err()}
+				return
+			}
+
+			reqCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			var config *ScrapeConfig
+			if configFunc != nil {
+				config = configFunc(addr)
+			}
+
+			klog.V(6).Infof("Fetching metrics from %s", addr)
+			series, err := fetchMetrics(reqCtx, addr, config, families, labels)
+			results <- result{addr: addr, series: series, err: err}
+		}()
+	}
+
+	scraped := make(map[string][]scrapedSeries, len(addrs))
+	failing := make(map[string]bool)
+	for range addrs {
+		r := <-results
+		m.account(r.addr, r.err)
+		if r.err != nil {
+			failing[r.addr] = true
+			continue
+		}
+
+		scraped[r.addr] = r.series
+	}
+
+	return scraped, failing
+}
+
+// account keeps track of the consecutive failures to scrape addr.
+func (m *ScrapeManager) account(addr string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err == nil {
+		if m.failures[addr] > 0 {
+			klog.V(2).Infof("Scraped %s again after %d failures", addr, m.failures[addr])
+		}
+		delete(m.failures, addr)
+		return
+	}
+
+	m.failures[addr]++
+	klog.V(4).Infof("Failed to scrape %s %d times in a row: %v", addr, m.failures[addr], err)
+}
+
+// Failures returns the number of consecutive failed scrapes of every
+// controller that is currently failing.
+func (m *ScrapeManager) Failures() map[string]int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return maps.Clone(m.failures)
+}
+
+// fetchMetrics scrapes url and returns the series of families with the
+// given labels, all of them if labels is nil, as configured by config. The
+// exposition format and gzip compression are negotiated with the
+// controller.
+func fetchMetrics(ctx context.Context, url string, config *ScrapeConfig, families map[string]bool, labels map[model.LabelName]bool) ([]scrapedSeries, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", acceptHeader)
+	// setting it explicitly disables the transparent decompression of the
+	// transport, the body is decompressed below
+	req.Header.Set("Accept-Encoding", "gzip")
+	if err := config.authorize(req); err != nil {
+		klog.Errorf("Failed to authorize scrape of %s: %v", url, err)
+		return nil, err
+	}
+
+	resp, err := config.httpClient().Do(req)
+	if err != nil {
+		klog.Errorf("Failed to fetch metrics from %s: %v", url, err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		klog.Errorf("Failed to fetch metrics from %s: %s", url, resp.Status)
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body := io.Reader(resp.Body)
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			klog.Errorf("Failed to decompress metrics from %s: %v", url, err)
+			return nil, err
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	series, err := decodeMetrics(body, resp.Header.Get("Content-Type"), families, labels)
+	if err != nil {
+		klog.Errorf("Failed to parse metrics from %s: %v", url, err)
+		return nil, err
+	}
+
+	return series, nil
+}
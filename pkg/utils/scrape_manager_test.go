@@ -0,0 +1,158 @@
+package utils
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestScrapeManagerScrape(t *testing.T) {
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "# TYPE test counter")
+		fmt.Fprintln(w, `test{ingress="web"} 42`)
+	}))
+	defer fast.Close()
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer hung.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	manager := NewScrapeManager(200 * time.Millisecond)
+	manager.SetScrapeOptions(ScrapeOptions{Timeout: 100 * time.Millisecond, Concurrency: 1})
+
+	addrs := map[string]bool{hung.URL: true, fast.URL: true, broken.URL: true}
+	families := map[string]bool{"test": true}
+	begin := time.Now()
+	scraped, failing := manager.scrape(context.Background(), addrs, families)
+	if elapsed := time.Since(begin); elapsed > 200*time.Millisecond {
+		t.Errorf("Expected the scrape to finish within the interval, took %s", elapsed)
+	}
+
+	if len(failing) != 2 || !failing[hung.URL] || !failing[broken.URL] {
+		t.Errorf("Expected the hung and broken controllers to fail, got %v", failing)
+	}
+	if series := scraped[fast.URL]; len(series) != 1 || series[0].sample.Value != 42 {
+		t.Errorf("Expected the sample of the fast controller, got %v", scraped)
+	}
+
+	manager.scrape(context.Background(), addrs, families)
+	if failures := manager.Failures(); failures[hung.URL] != 2 || failures[fast.URL] != 0 {
+		t.Errorf("Expected the hung controller to have failed twice, got %v", failures)
+	}
+
+	// the broken controller is gone
+	cache := NewCounterCache("nginx", 200*time.Millisecond, time.Second, make(chan []string))
+	cache.AddFamily("test")
+	cache.addrs = []string{hung.URL, fast.URL}
+	manager.Register(cache)
+	manager.ScrapeOnce(context.Background(), time.Now())
+	if failures := manager.Failures(); len(failures) != 1 || failures[hung.URL] != 3 {
+		t.Errorf("Expected only the failures of the hung controller to be kept, got %v", failures)
+	}
+}
+
+func TestScrapeManagerFanOut(t *testing.T) {
+	var requests atomic.Int32
+	shared := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		fmt.Fprintln(w, "# TYPE qps counter")
+		fmt.Fprintln(w, `qps{ingress="web"} 10`)
+		fmt.Fprintln(w, "# TYPE errors counter")
+		fmt.Fprintln(w, `errors{ingress="web"} 1`)
+	}))
+	defer shared.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		fmt.Fprintln(w, "# TYPE qps counter")
+		fmt.Fprintln(w, `qps{ingress="api"} 20`)
+	}))
+	defer other.Close()
+
+	manager := NewScrapeManager(time.Second)
+	all := NewCounterCache("*", time.Second, 5*time.Second, make(chan []string))
+	all.AddFamily("qps")
+	all.addrs = []string{shared.URL, other.URL}
+	manager.Register(all)
+	some := NewCounterCache("nginx", time.Second, 5*time.Second, make(chan []string))
+	some.AddFamily("errors")
+	some.addrs = []string{shared.URL}
+	manager.Register(some)
+
+	manager.ScrapeOnce(context.Background(), testStart)
+	if n := requests.Load(); n != 2 {
+		t.Errorf("Expected every controller to be scraped once, got %d requests", n)
+	}
+
+	if totals, err := all.totals("qps", `qps{ingress="api"}`, time.Second, testStart); err != nil || len(totals) != 1 || totals[0] != 20 {
+		t.Errorf("Expected the qps of the other controller, got %v, %v", totals, err)
+	}
+	if totals, err := some.totals("errors", `errors{ingress="web"}`, time.Second, testStart); err != nil || len(totals) != 1 || totals[0] != 1 {
+		t.Errorf("Expected the errors of the shared controller, got %v, %v", totals, err)
+	}
+	if _, err := some.totals("qps", `qps{ingress="web"}`, time.Second, testStart); err == nil {
+		t.Error("Expected families a cache did not add to be left out")
+	}
+}
+
+func TestFetchMetricsNegotiation(t *testing.T) {
+	payload := "# TYPE test counter\ntest{ingress=\"web\"} 42\n"
+
+	for _, supported := range []expfmt.Format{
+		expfmt.NewFormat(expfmt.TypeProtoDelim),
+		expfmt.NewFormat(expfmt.TypeOpenMetrics),
+		expfmt.NewFormat(expfmt.TypeTextPlain),
+	} {
+		var served expfmt.Format
+		var compressed bool
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// a controller that only speaks one format, and falls back to
+			// the text format if the scraper does not accept it
+			served = expfmt.NewFormat(expfmt.TypeTextPlain)
+			mediaType, _, _ := strings.Cut(string(supported), ";")
+			if strings.Contains(r.Header.Get("Accept"), mediaType) {
+				served = supported
+			}
+			w.Header().Set("Content-Type", string(served))
+
+			var body io.Writer = w
+			compressed = strings.Contains(r.Header.Get("Accept-Encoding"), "gzip")
+			if compressed {
+				w.Header().Set("Content-Encoding", "gzip")
+				gz := gzip.NewWriter(w)
+				defer gz.Close()
+				body = gz
+			}
+			body.Write(encodePayload(t, []byte(payload), served))
+		}))
+
+		series, err := fetchMetrics(context.Background(), server.URL, nil, map[string]bool{"test": true}, nil)
+		server.Close()
+		if err != nil {
+			t.Errorf("Expected no error for %s, got %v", supported, err)
+			continue
+		}
+
+		if served.FormatType() != supported.FormatType() {
+			t.Errorf("Expected %s to be negotiated, got %s", supported, served)
+		}
+		if !compressed {
+			t.Errorf("Expected gzip to be negotiated for %s", supported)
+		}
+		if len(series) != 1 || series[0].sample.Value != 42 {
+			t.Errorf("Expected the sample served as %s, got %v", supported, series)
+		}
+	}
+}